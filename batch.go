@@ -0,0 +1,374 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inputs smaller than this are compressed single-threaded, running several
+// of them in parallel instead
+const BATCH_SMALL_INPUT = 16384
+
+// threadBudget is a weighted semaphore limiting the total number of
+// optimizer threads used by files processed concurrently.
+type threadBudget struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	available int
+}
+
+func newThreadBudget(threads int) *threadBudget {
+	budget := &threadBudget{available: threads}
+	budget.cond = sync.NewCond(&budget.mutex)
+	return budget
+}
+
+func (b *threadBudget) acquire(threads int) {
+	b.mutex.Lock()
+	for b.available < threads {
+		b.cond.Wait()
+	}
+	b.available -= threads
+	b.mutex.Unlock()
+}
+
+func (b *threadBudget) release(threads int) {
+	b.mutex.Lock()
+	b.available += threads
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+}
+
+// isBatchArgument reports whether a command-line argument refers to several
+// files, either as a glob pattern or as a directory.
+func isBatchArgument(arg string) bool {
+	if strings.ContainsAny(arg, "*?[") {
+		return true
+	}
+	info, err := os.Stat(arg)
+	return err == nil && info.IsDir()
+}
+
+// expandBatchInputs resolves glob patterns and directories into the list of
+// files to process. Directories are searched recursively for ".zx0" files
+// when decompressing, or for any other file when compressing.
+func expandBatchInputs(args []string, decompress bool) ([]string, error) {
+	inputs := []string{}
+	seen := map[string]bool{}
+	add := func(filename string) {
+		if !seen[filename] {
+			seen[filename] = true
+			inputs = append(inputs, filename)
+		}
+	}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil || len(matches) == 0 {
+				return nil, fmt.Errorf("No files matching %s", arg)
+			}
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && !info.IsDir() {
+					add(match)
+				}
+			}
+		} else if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			err := filepath.WalkDir(arg, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if entry.Type().IsRegular() && strings.HasSuffix(path, ".zx0") == decompress {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read directory %s", arg)
+			}
+		} else {
+			add(arg)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("No input files")
+	}
+	return inputs, nil
+}
+
+// batch compresses or decompresses many files, sharing the thread budget
+// among them: small files run in parallel with a single thread each, while
+// large ones get all threads for themselves. A summary table is printed at
+// the end. It returns false if any file failed.
+func batch(inputs []string, options *Options, config fileConfig) bool {
+	threads := options.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	// apply configuration overrides for each file
+	fileOptions := make([]*Options, len(inputs))
+	results := make([]*FileResult, len(inputs))
+	sizes := make([]int64, len(inputs))
+	order := make([]int, len(inputs))
+	for i, input := range inputs {
+		fileOptions[i] = config(input)
+		results[i] = newFileResult(input, fileOptions[i], 1)
+		if info, err := os.Stat(input); err == nil {
+			sizes[i] = info.Size()
+		}
+		order[i] = i
+	}
+
+	// start with the largest files, so small ones fill the gaps at the end
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]] > sizes[order[j]]
+	})
+
+	budget := newThreadBudget(threads)
+	var wg sync.WaitGroup
+	for _, i := range order {
+		fileThreads := threads
+		if sizes[i] < BATCH_SMALL_INPUT || options.Decompress {
+			fileThreads = 1
+		}
+		results[i].Threads = fileThreads
+		budget.acquire(fileThreads)
+		wg.Add(1)
+		go func(result *FileResult, options *Options, fileThreads int) {
+			defer wg.Done()
+			defer budget.release(fileThreads)
+			processBatchFile(result, options, fileThreads)
+			if result.Err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", result.Err)
+			}
+		}(results[i], fileOptions[i], fileThreads)
+	}
+	wg.Wait()
+
+	if options.JsonMode {
+		for _, result := range results {
+			result.printJson(options)
+		}
+	}
+	return printBatchSummary(results, options)
+}
+
+func processBatchFile(result *FileResult, options *Options, threads int) {
+
+	if err := checkOptions(options, threads); err != nil {
+		result.Err = err
+		return
+	}
+	if err := checkBatch(options); err != nil {
+		result.Err = err
+		return
+	}
+
+	if options.Decompress {
+		if !strings.HasSuffix(result.Input, ".zx0") || len(result.Input) <= 4 {
+			result.Err = fmt.Errorf("Cannot infer output filename for %s", result.Input)
+			return
+		}
+		result.Output = strings.TrimSuffix(result.Input, ".zx0")
+	} else {
+		result.Output = result.Input + ".zx0"
+	}
+
+	input, err := os.ReadFile(result.Input)
+	if err != nil {
+		result.Err = fmt.Errorf("Cannot read input file %s", result.Input)
+		return
+	}
+	result.InputSize = len(input)
+	if len(input) == 0 {
+		result.Err = fmt.Errorf("Empty input file %s", result.Input)
+		return
+	}
+	if options.Skip >= len(input) {
+		result.Err = fmt.Errorf("Skipping entire input file %s", result.Input)
+		return
+	}
+	if !options.ForcedMode && fileExists(result.Output) {
+		result.Err = fmt.Errorf("Already existing output file %s", result.Output)
+		return
+	}
+
+	start := time.Now()
+	var best *BestCandidate
+	cacheName := ""
+	if !options.Decompress && !options.NoCache {
+		cacheName = cacheKey(input, options)
+		best = readCache(cacheName)
+		result.Cached = best != nil
+	}
+	if best == nil && options.BestMode {
+		best, err = compressBest(input, options, threads, false)
+		if err != nil {
+			result.Err = err
+			return
+		}
+	}
+	if best != nil {
+		// the options are shared by all files
+		fileOptions := *options
+		fileOptions.BackwardsMode, fileOptions.ClassicMode = best.Backwards, best.Classic
+		options = &fileOptions
+		result.Backwards, result.Classic = best.Backwards, best.Classic
+	}
+
+	if options.BackwardsMode {
+		reverse(input)
+	}
+	var output []byte
+	if !options.Decompress {
+		delta := []int{0}
+		if best != nil {
+			output, delta[0] = best.Output, best.Delta
+			result.PeakMemory = best.PeakMemory
+		} else if options.BlockSize > 0 {
+			output = compressBlocks(input, options, threads, false)
+		} else {
+			output = zx0Fn(input, options.Skip, options.BackwardsMode, options.ClassicMode, options.level(), threads, options.MaxMemory, false, delta, &result.PeakMemory)
+		}
+		result.Delta = delta[0]
+		result.Elapsed = time.Since(start).Seconds()
+		if options.VerifyMode {
+			result.verify(input, output)
+			if result.Verified != nil && !*result.Verified {
+				result.Err = fmt.Errorf("Verification failed for %s", result.Input)
+				return
+			}
+		}
+		if cacheName != "" && !result.Cached {
+			writeCache(cacheName, &BestCandidate{options.BackwardsMode, options.ClassicMode, output, delta[0], 0})
+		}
+	} else {
+		output, err = dzx0Fn(input, options.BackwardsMode, options.ClassicMode)
+		if err != nil {
+			result.Err = fmt.Errorf("Invalid input file %s", result.Input)
+			return
+		}
+		result.Elapsed = time.Since(start).Seconds()
+	}
+	if options.BackwardsMode {
+		reverse(output)
+	}
+	result.OutputSize = len(output)
+
+	if err := os.WriteFile(result.Output, output, 0644); err != nil {
+		result.Err = fmt.Errorf("Cannot write output file %s", result.Output)
+	}
+}
+
+func printBatchSummary(results []*FileResult, options *Options) bool {
+	width := len("Total")
+	for _, result := range results {
+		width = max(width, len(result.Input))
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%-*s %10s %10s %8s%s%s%s\n", width, "File", "Input", "Output", "Ratio", batchDelta("Delta", options), batchMemory("Memory", options), batchMode("Mode", options))
+	failed, totalInput, totalOutput := 0, 0, 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%-*s %10s\n", width, result.Input, "failed")
+			continue
+		}
+		totalInput += result.InputSize - result.Skip
+		totalOutput += result.OutputSize
+		fmt.Fprintf(os.Stderr, "%-*s %10d %10d %7.2f%%%s%s%s\n", width, result.Input,
+			result.InputSize-result.Skip, result.OutputSize, ratio(result.InputSize-result.Skip, result.OutputSize, options),
+			batchDelta(result.Delta, options), batchMemory(fmt.Sprintf("%.1fMB", megabytes(uint64(result.PeakMemory))), options),
+			batchMode(modeFlags(result), options))
+	}
+	fmt.Fprintf(os.Stderr, "%-*s %10d %10d %7.2f%%\n", width, "Total", totalInput, totalOutput, ratio(totalInput, totalOutput, options))
+
+	verb := "compressed"
+	if options.Decompress {
+		verb = "decompressed"
+	}
+	fmt.Fprintf(os.Stderr, "\n%d file(s) %s", len(results)-failed, verb)
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, ", %d failed", failed)
+	}
+	fmt.Fprintln(os.Stderr, "!")
+	return failed == 0
+}
+
+// ratio returns the compressed size as a percentage of the decompressed size.
+func ratio(input, output int, options *Options) float64 {
+	if options.Decompress {
+		input, output = output, input
+	}
+	if input == 0 {
+		return 0
+	}
+	return float64(output) * 100 / float64(input)
+}
+
+// batchDelta formats the delta column, which only applies to compression.
+func batchDelta(delta any, options *Options) string {
+	if options.Decompress {
+		return ""
+	}
+	return fmt.Sprintf(" %6v", delta)
+}
+
+// batchMemory formats the peak memory column, which only applies to
+// compression.
+func batchMemory(memory string, options *Options) string {
+	if options.Decompress {
+		return ""
+	}
+	return fmt.Sprintf(" %9s", memory)
+}
+
+// batchMode formats the mode column, showing the flags chosen by "-best".
+func batchMode(mode string, options *Options) string {
+	if !options.BestMode {
+		return ""
+	}
+	return "  " + mode
+}
+
+func modeFlags(result *FileResult) string {
+	switch {
+	case result.Backwards:
+		return "-b"
+	case result.Classic:
+		return "-c"
+	}
+	return "-"
+}
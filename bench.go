@@ -0,0 +1,383 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// BenchMode is a combination of settings measured by the benchmark.
+type BenchMode struct {
+	Name      string
+	Level     int
+	Classic   bool
+	Backwards bool
+}
+
+// backwards streams are identical in both file formats, so only one is run
+var benchModes = []BenchMode{
+	{"optimal", zx0.LEVEL_OPTIMAL, false, false},
+	{"optimal classic", zx0.LEVEL_OPTIMAL, true, false},
+	{"optimal backwards", zx0.LEVEL_OPTIMAL, false, true},
+	{"quick", zx0.LEVEL_QUICK, false, false},
+	{"quick classic", zx0.LEVEL_QUICK, true, false},
+	{"quick backwards", zx0.LEVEL_QUICK, false, true},
+	{"lazy", 5, false, false},
+	{"lazy backwards", 5, false, true},
+	{"greedy", 2, false, false},
+	{"greedy backwards", 2, false, true},
+}
+
+// BenchRecord is the measurement of a file with a mode and thread count.
+type BenchRecord struct {
+	File       string  `json:"file"`
+	Mode       string  `json:"mode"`
+	Threads    int     `json:"threads"`
+	InputSize  int     `json:"input_size"`
+	OutputSize int     `json:"output_size"`
+	Ratio      float64 `json:"ratio"`
+	Compress   float64 `json:"compress_seconds"`
+	Decompress float64 `json:"decompress_seconds"`
+	Allocated  uint64  `json:"allocated_bytes"`
+	GCs        uint32  `json:"gc_cycles"`
+	Best       bool    `json:"best"`
+	output     []byte
+}
+
+// benchCommand compresses files with every mode and thread count, reporting
+// sizes and times. Results can be saved and compared with a later run to
+// detect changes in compressed sizes. Compressed data must be identical with
+// every thread count, or the benchmark fails.
+func benchCommand(arguments []string) {
+	var runs int
+	var maxMemory int64
+	var threadList, modeList, saveName, compareName, cpuProfile, memProfile string
+	var jsonMode bool
+	flags := newFlagSet("bench")
+	flags.StringVar(&threadList, "threads", strconv.Itoa(DEFAULT_THREADS), "Comma-separated thread counts to measure, 0 for all CPUs")
+	flags.StringVar(&modeList, "modes", "", "Comma-separated modes to measure, all by default:\n"+benchModeNames())
+	flags.IntVar(&runs, "n", 1, "Repeat each measurement N times, keeping the fastest")
+	flags.Var((*memorySize)(&maxMemory), "maxmem", "Limit optimizer memory to N bytes, or with suffix K, M or G")
+	flags.BoolVar(&jsonMode, "json", false, "Report results as JSON records, one line per measurement")
+	flags.StringVar(&saveName, "save", "", "Save results to a JSON file")
+	flags.StringVar(&compareName, "compare", "", "Compare compressed sizes with results saved by -save")
+	flags.StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile of the whole benchmark to a file")
+	flags.StringVar(&memProfile, "memprofile", "", "Write a memory allocation profile of the whole benchmark to a file")
+	flags.Parse(arguments)
+	if flags.NArg() < 1 || runs < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	threads := []int{}
+	for _, field := range strings.Split(threadList, ",") {
+		count, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid thread count %s\n", field)
+			os.Exit(1)
+		}
+		if err := checkMaxMemory(maxMemory, count, 1); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		threads = append(threads, count)
+	}
+	modes, err := selectBenchModes(modeList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	inputs, err := expandBatchInputs(flags.Args(), false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cpuProfile != "" {
+		file, err := os.Create(cpuProfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", cpuProfile)
+			os.Exit(1)
+		}
+		defer file.Close()
+		pprof.StartCPUProfile(file)
+		defer pprof.StopCPUProfile()
+	}
+	if memProfile != "" {
+		runtime.MemProfileRate = 64 * 1024
+	}
+
+	records := []*BenchRecord{}
+	for _, filename := range inputs {
+		input, err := os.ReadFile(filename)
+		if err != nil || len(input) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", filename)
+			os.Exit(1)
+		}
+		fileRecords := []*BenchRecord{}
+		for _, mode := range modes {
+			var reference *BenchRecord
+			for _, count := range threads {
+				record, err := benchFile(filename, input, mode, count, runs, maxMemory)
+				if err == nil && reference != nil && !bytes.Equal(record.output, reference.output) {
+					err = fmt.Errorf("Output of %s in mode %s differs with %d and %d threads", filename, mode.Name, reference.Threads, count)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				if reference == nil {
+					reference = record
+				} else {
+					record.output = nil
+				}
+				fileRecords = append(fileRecords, record)
+			}
+			reference.output = nil
+		}
+
+		// the smallest output is best, the fastest among equal sizes
+		best := fileRecords[0]
+		for _, record := range fileRecords[1:] {
+			if record.OutputSize < best.OutputSize || record.OutputSize == best.OutputSize && record.Compress < best.Compress {
+				best = record
+			}
+		}
+		best.Best = true
+		records = append(records, fileRecords...)
+	}
+
+	if memProfile != "" {
+		if err := writeMemProfile(memProfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", memProfile)
+			os.Exit(1)
+		}
+	}
+
+	if jsonMode {
+		for _, record := range records {
+			line, _ := json.Marshal(record)
+			fmt.Println(string(line))
+		}
+	} else {
+		printBenchResults(records, modes, threads)
+	}
+
+	if saveName != "" {
+		data, _ := json.MarshalIndent(records, "", "  ")
+		if err := os.WriteFile(saveName, append(data, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", saveName)
+			os.Exit(1)
+		}
+	}
+	if compareName != "" && !compareBenchResults(records, compareName) {
+		pprof.StopCPUProfile()
+		os.Exit(1)
+	}
+}
+
+// writeMemProfile writes the allocations made since the start of the
+// program, for "go tool pprof -sample_index=alloc_space".
+func writeMemProfile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return pprof.Lookup("allocs").WriteTo(file, 0)
+}
+
+func benchModeNames() string {
+	names := []string{}
+	for _, mode := range benchModes {
+		names = append(names, strings.ReplaceAll(mode.Name, " ", "-"))
+	}
+	return strings.Join(names, ", ")
+}
+
+func selectBenchModes(list string) ([]BenchMode, error) {
+	if list == "" {
+		return benchModes, nil
+	}
+	modes := []BenchMode{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ReplaceAll(strings.TrimSpace(name), "-", " ")
+		found := false
+		for _, mode := range benchModes {
+			if mode.Name == name {
+				modes = append(modes, mode)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown mode %s", name)
+		}
+	}
+	return modes, nil
+}
+
+// benchFile measures a single file, checking that it decompresses back.
+func benchFile(filename string, input []byte, mode BenchMode, threads, runs int, maxMemory int64) (*BenchRecord, error) {
+	data := append([]byte{}, input...)
+	if mode.Backwards {
+		reverse(data)
+	}
+
+	var output, decompressed []byte
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	compressTime := measure(runs, func() {
+		output = zx0Fn(data, 0, mode.Backwards, mode.Classic, mode.Level, threads, maxMemory, false, []int{0}, nil)
+	})
+	runtime.ReadMemStats(&after)
+	var err error
+	decompressTime := measure(runs, func() {
+		decompressed, err = dzx0Fn(output, mode.Backwards, mode.Classic)
+	})
+	if err != nil || !bytes.Equal(decompressed, data) {
+		return nil, fmt.Errorf("Verification failed for %s in mode %s", filename, mode.Name)
+	}
+
+	return &BenchRecord{
+		File:       filename,
+		Mode:       mode.Name,
+		Threads:    threads,
+		InputSize:  len(input),
+		OutputSize: len(output),
+		Ratio:      float64(len(output)) * 100 / float64(len(input)),
+		Compress:   compressTime.Seconds(),
+		Decompress: decompressTime.Seconds(),
+		Allocated:  (after.TotalAlloc - before.TotalAlloc) / uint64(runs),
+		GCs:        (after.NumGC - before.NumGC) / uint32(runs),
+		output:     output,
+	}, nil
+}
+
+func printBenchResults(records []*BenchRecord, modes []BenchMode, threads []int) {
+	width := len("Total")
+	for _, record := range records {
+		width = max(width, len(record.File))
+	}
+
+	fmt.Printf("%-*s %-18s %7s %10s %10s %8s %10s %10s %10s %5s\n", width, "File", "Mode", "Threads", "Input", "Output", "Ratio", "Compress", "Decompress", "Allocated", "GCs")
+	for _, record := range records {
+		best := ""
+		if record.Best {
+			best = " *"
+		}
+		fmt.Printf("%-*s %-18s %7d %10d %10d %7.2f%% %9.3fs %9.4fs %8.1fMB %5d%s\n", width, record.File, record.Mode, record.Threads,
+			record.InputSize, record.OutputSize, record.Ratio, record.Compress, record.Decompress, megabytes(record.Allocated), record.GCs, best)
+	}
+
+	fmt.Printf("\n%-*s %-18s %7s %10s %10s %8s %10s %10s %10s %5s\n", width, "Total", "Mode", "Threads", "Input", "Output", "Ratio", "Compress", "Decompress", "Allocated", "GCs")
+	for _, mode := range modes {
+		for _, count := range threads {
+			total := &BenchRecord{Mode: mode.Name, Threads: count}
+			for _, record := range records {
+				if record.Mode == mode.Name && record.Threads == count {
+					total.InputSize += record.InputSize
+					total.OutputSize += record.OutputSize
+					total.Compress += record.Compress
+					total.Decompress += record.Decompress
+					total.Allocated += record.Allocated
+					total.GCs += record.GCs
+				}
+			}
+			fmt.Printf("%-*s %-18s %7d %10d %10d %7.2f%% %9.3fs %9.4fs %8.1fMB %5d\n", width, "", total.Mode, total.Threads,
+				total.InputSize, total.OutputSize, float64(total.OutputSize)*100/float64(total.InputSize), total.Compress, total.Decompress,
+				megabytes(total.Allocated), total.GCs)
+		}
+	}
+	fmt.Println("\n* smallest output of each file, the fastest among equal sizes")
+}
+
+// compareBenchResults reports compressed sizes differing from saved results,
+// returning false if any got larger.
+func compareBenchResults(records []*BenchRecord, filename string) bool {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", filename)
+		os.Exit(1)
+	}
+	saved := []*BenchRecord{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid results file %s\n", filename)
+		os.Exit(1)
+	}
+	sizes := map[string]int{}
+	for _, record := range saved {
+		sizes[record.File+"\x00"+record.Mode] = record.OutputSize
+	}
+
+	regressions, improvements, compared := 0, 0, 0
+	for _, record := range records {
+		size, found := sizes[record.File+"\x00"+record.Mode]
+		if !found {
+			continue
+		}
+		compared++
+		if record.OutputSize > size {
+			regressions++
+			fmt.Fprintf(os.Stderr, "Regression: %s (%s, %d threads) grew from %d to %d bytes\n",
+				record.File, record.Mode, record.Threads, size, record.OutputSize)
+		} else if record.OutputSize < size {
+			improvements++
+			fmt.Fprintf(os.Stderr, "Improvement: %s (%s, %d threads) shrank from %d to %d bytes\n",
+				record.File, record.Mode, record.Threads, size, record.OutputSize)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Compared %d results with %s: %d regression(s), %d improvement(s)\n",
+		compared, filename, regressions, improvements)
+	return regressions == 0
+}
+
+func megabytes(bytes uint64) float64 {
+	return float64(bytes) / (1024 * 1024)
+}
+
+// measure returns the fastest of several runs of a function.
+func measure(runs int, function func()) time.Duration {
+	fastest := time.Duration(0)
+	for i := 0; i < runs; i++ {
+		start := time.Now()
+		function()
+		if elapsed := time.Since(start); i == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	return fastest
+}
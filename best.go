@@ -0,0 +1,133 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// BestCandidate is a compressed output produced while searching for the
+// smallest mode.
+type BestCandidate struct {
+	Backwards bool
+	Classic   bool
+	Output    []byte
+	Delta     int
+
+	// memory measured while compressing, including the other candidates
+	// compressed at the same time
+	PeakMemory int64
+}
+
+func (c *BestCandidate) Name() string {
+	switch {
+	case c.Backwards:
+		return "backwards (-b)"
+	case c.Classic:
+		return "classic (-c)"
+	}
+	return "current"
+}
+
+// parseBestModes validates the list of modes allowed by the target decoder.
+func parseBestModes(list string) (forward, classic, backwards bool, err error) {
+	for _, mode := range strings.Split(list, ",") {
+		switch strings.TrimSpace(mode) {
+		case "v2":
+			forward = true
+		case "v1":
+			classic = true
+		case "backwards":
+			backwards = true
+		default:
+			return false, false, false, fmt.Errorf("Unknown mode %s", mode)
+		}
+	}
+	return forward, classic, backwards, nil
+}
+
+// compressBest compresses the input both forward and backwards in parallel,
+// sharing the threads, keeping the smallest output among the modes allowed.
+// Both file formats always produce the same size, so the current one is
+// preferred when allowed, and forward is preferred to backwards on ties.
+// The output is returned as produced by the compressor, reversed for
+// backwards mode.
+func compressBest(input []byte, o *Options, threads int, verbose bool) (*BestCandidate, error) {
+	forward, classic, backwards, err := parseBestModes(o.BestModes)
+	if err != nil {
+		return nil, err
+	}
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	candidates := []*BestCandidate{}
+	if forward || classic {
+		candidates = append(candidates, &BestCandidate{Classic: !forward})
+	}
+	if backwards {
+		candidates = append(candidates, &BestCandidate{Backwards: true})
+	}
+	threads = max(threads/len(candidates), 1)
+	maxMemory := o.MaxMemory / int64(len(candidates))
+
+	var wg sync.WaitGroup
+	for _, candidate := range candidates {
+		wg.Add(1)
+		go func(candidate *BestCandidate) {
+			defer wg.Done()
+			data := append([]byte{}, input...)
+			if candidate.Backwards {
+				reverse(data)
+			}
+			delta := []int{0}
+			candidate.Output = zx0Fn(data, o.Skip, candidate.Backwards, candidate.Classic, o.level(), threads, maxMemory, false, delta, &candidate.PeakMemory)
+			candidate.Delta = delta[0]
+		}(candidate)
+	}
+	wg.Wait()
+
+	best := candidates[0]
+	peakMemory := int64(0)
+	for _, candidate := range candidates {
+		peakMemory = max(peakMemory, candidate.PeakMemory)
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Mode %s: %d bytes (delta %d)\n", candidate.Name(), len(candidate.Output), candidate.Delta)
+		}
+		if len(candidate.Output) < len(best.Output) {
+			best = candidate
+		}
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Best mode: %s\n", best.Name())
+	}
+	best.PeakMemory = peakMemory
+	return best, nil
+}
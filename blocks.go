@@ -0,0 +1,57 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// checkBlocks reports options that can't be used with block containers.
+func checkBlocks(o *Options) error {
+	if o.BlockSize <= 0 || o.Decompress {
+		return nil
+	}
+	if o.BackwardsMode || o.Skip > 0 || o.BestMode || o.RomSize != "" || o.XexMode {
+		return fmt.Errorf("Block containers require forward compression of the whole file")
+	}
+	if o.BlockSize > 1<<31 || o.BlockDictionary > 1<<31 {
+		return fmt.Errorf("Block and dictionary sizes are limited to 2G")
+	}
+	return nil
+}
+
+// compressBlocks compresses an input as a container of independent blocks,
+// using every thread for a different block.
+func compressBlocks(input []byte, o *Options, threads int, verbose bool) []byte {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Blocks: %d of %d bytes, dictionary of %d bytes\n",
+			(len(input)+int(o.BlockSize)-1)/int(o.BlockSize), o.BlockSize, o.BlockDictionary)
+	}
+	return zx0.CompressContainer(input, int(o.BlockSize), int(o.BlockDictionary), o.level(), threads, o.ClassicMode)
+}
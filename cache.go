@@ -0,0 +1,296 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// directory of the cache inside the user cache directory
+	CACHE_NAME = "zx0-go"
+
+	CACHE_MAGIC     = "ZX0C"
+	CACHE_EXTENSION = ".zx0c"
+)
+
+// cache entry flags
+const (
+	CACHE_BACKWARDS = 1 << iota
+	CACHE_CLASSIC
+)
+
+// cacheHeader precedes the compressed data of a cache entry.
+type cacheHeader struct {
+	Magic [4]byte
+	Flags uint8
+	_     [3]byte
+	Delta int32
+}
+
+// cacheDirectory returns the directory of the compression cache, following
+// $XDG_CACHE_HOME on Linux.
+func cacheDirectory() (string, error) {
+	directory, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(directory, CACHE_NAME), nil
+}
+
+// toolVersion identifies the build of the compressor, so cached outputs of
+// other builds aren't reused. Builds from modified sources, or without
+// version control information, are identified by the hash of the executable.
+var toolVersion = sync.OnceValue(func() string {
+	version := VERSION
+	revision, modified := "", true
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if revision != "" && !modified {
+		return version + " " + revision
+	}
+	executable, err := os.Executable()
+	if err == nil {
+		var file *os.File
+		if file, err = os.Open(executable); err == nil {
+			defer file.Close()
+			hash := sha256.New()
+			if _, err = io.Copy(hash, file); err == nil {
+				return version + " " + hex.EncodeToString(hash.Sum(nil))
+			}
+		}
+	}
+	// no way to tell builds apart, so nothing is shared between them
+	return fmt.Sprintf("%s %d", version, time.Now().UnixNano())
+})
+
+// cacheKey hashes everything that determines the compressed output of an
+// input: the tool version, the options affecting the output and the input
+// itself. The number of threads doesn't change the output, so it's left out.
+func cacheKey(input []byte, o *Options) string {
+	bestModes := ""
+	if o.BestMode {
+		bestModes = o.BestModes
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00skip=%d level=%d backwards=%t classic=%t best=%t bestmodes=%s maxmem=%d blocks=%d dict=%d\x00",
+		toolVersion(), o.Skip, o.level(), o.BackwardsMode, o.ClassicMode, o.BestMode, bestModes, o.MaxMemory, o.BlockSize, o.BlockDictionary)
+	hash.Write(input)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// readCache returns the output cached under a key, as produced by the
+// compressor, or nil if there is none. Using an entry marks it as recently
+// used, so pruning keeps it.
+func readCache(key string) *BestCandidate {
+	directory, err := cacheDirectory()
+	if err != nil {
+		return nil
+	}
+	filename := filepath.Join(directory, key+CACHE_EXTENSION)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	header := cacheHeader{}
+	size := binary.Size(header)
+	if len(data) <= size || binary.Read(bytes.NewReader(data), binary.LittleEndian, &header) != nil ||
+		string(header.Magic[:]) != CACHE_MAGIC || header.Delta < 0 {
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+	return &BestCandidate{
+		Backwards: header.Flags&CACHE_BACKWARDS != 0,
+		Classic:   header.Flags&CACHE_CLASSIC != 0,
+		Output:    data[size:],
+		Delta:     int(header.Delta),
+	}
+}
+
+// writeCache stores an output under a key. Entries are written to a
+// temporary file first, so concurrent runs never see partial entries.
+func writeCache(key string, candidate *BestCandidate) error {
+	directory, err := cacheDirectory()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	header := cacheHeader{Delta: int32(candidate.Delta)}
+	copy(header.Magic[:], CACHE_MAGIC)
+	if candidate.Backwards {
+		header.Flags |= CACHE_BACKWARDS
+	}
+	if candidate.Classic {
+		header.Flags |= CACHE_CLASSIC
+	}
+	data := &bytes.Buffer{}
+	binary.Write(data, binary.LittleEndian, &header)
+	data.Write(candidate.Output)
+
+	file, err := os.CreateTemp(directory, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(directory, key+CACHE_EXTENSION))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// cacheEntry is a file of the cache directory.
+type cacheEntry struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// listCache returns the entries of the cache, least recently used first,
+// along with temporary files left by interrupted runs.
+func listCache(directory string) ([]cacheEntry, error) {
+	files, err := os.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []cacheEntry{}
+	for _, file := range files {
+		if !file.Type().IsRegular() || !strings.HasSuffix(file.Name(), CACHE_EXTENSION) && !strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cacheEntry{filepath.Join(directory, file.Name()), info.Size(), info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	return entries, nil
+}
+
+// cacheCommand shows, prunes or clears the compression cache. Pruning
+// removes entries unused for longer than "-maxage", then the least recently
+// used ones until the cache fits in "-maxsize".
+func cacheCommand(arguments []string) {
+	var maxAge time.Duration
+	var maxSize int64
+	flags := newFlagSet("cache")
+	flags.DurationVar(&maxAge, "maxage", 30*24*time.Hour, "Prune entries unused for longer than this")
+	flags.Var((*memorySize)(&maxSize), "maxsize", "Prune least recently used entries until the cache fits in N bytes,\nor with suffix K, M or G, if not 0")
+	flags.Parse(arguments)
+	action := "info"
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(1)
+	} else if flags.NArg() == 1 {
+		action = flags.Arg(0)
+	}
+
+	directory, err := cacheDirectory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot locate cache directory, %v\n", err)
+		os.Exit(1)
+	}
+	entries, err := listCache(directory)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot read cache directory %s\n", directory)
+		os.Exit(1)
+	}
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	var remove []cacheEntry
+	switch action {
+	case "info":
+		fmt.Fprintf(os.Stderr, "Cache directory: %s\n", directory)
+		fmt.Fprintf(os.Stderr, "Entries: %d, %.1fMB\n", len(entries), megabytes(uint64(total)))
+		return
+	case "clear":
+		remove = entries
+	case "prune":
+		// entries are sorted by last use, so the ones to remove come first
+		cutoff := time.Now().Add(-maxAge)
+		size := total
+		for _, entry := range entries {
+			if !entry.used.Before(cutoff) && (maxSize == 0 || size <= maxSize) {
+				break
+			}
+			remove = append(remove, entry)
+			size -= entry.size
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown cache action %s\n", action)
+		os.Exit(1)
+	}
+
+	removed, freed := 0, int64(0)
+	for _, entry := range remove {
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: Cannot remove cache entry %s\n", entry.path)
+			continue
+		}
+		removed++
+		freed += entry.size
+	}
+	fmt.Fprintf(os.Stderr, "Removed %d cache entries, %.1fMB, keeping %d entries, %.1fMB\n",
+		removed, megabytes(uint64(freed)), len(entries)-removed, megabytes(uint64(total-freed)))
+}
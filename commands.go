@@ -0,0 +1,333 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mojzesh/zx0-go/formats"
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// Options holds the command-line parameters of the compress and decompress
+// commands, and of the legacy syntax combining both.
+type Options struct {
+	Threads         int
+	ForcedMode      bool
+	ClassicMode     bool
+	BackwardsMode   bool
+	QuickMode       bool
+	Level           int
+	Decompress      bool
+	Skip            int
+	MaxMemory       int64
+	Checkpoint      string
+	CheckpointEvery time.Duration
+	BlockSize       int64
+	BlockDictionary int64
+	StdoutMode      bool
+	BatchMode       bool
+	JsonMode        bool
+	BestMode        bool
+	BestModes       string
+	NoCache         bool
+	NoConfig        bool
+	VerifyMode      bool
+	AmsdosMode      bool
+	BloadMode       bool
+	Plus3dosMode    bool
+	LoadAddress     int
+	ExecAddress     int
+	DskName         string
+	DskFormat       string
+	DskExtended     bool
+	TrdName         string
+	SclName         string
+	RomSize         string
+	XexMode         bool
+	XexMerge        bool
+	XexDecoder      int
+	XexZeroPage     int
+}
+
+func (o *Options) threadFlags(flags *flag.FlagSet) {
+	flags.IntVar(&o.Threads, "p", DEFAULT_THREADS, "Parallel processing with N threads, if p <= 0\nthen all available CPUs are used")
+}
+
+func (o *Options) formatFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.ClassicMode, "c", false, "Classic file format (v1.*)")
+	flags.BoolVar(&o.BackwardsMode, "b", false, "Compress backwards")
+}
+
+func (o *Options) compressionFlags(flags *flag.FlagSet) {
+	o.threadFlags(flags)
+	o.levelFlags(flags)
+	flags.IntVar(&o.Skip, "s", 0, "Skip N bytes")
+	o.memoryFlags(flags)
+	flags.StringVar(&o.Checkpoint, "checkpoint", "", "Save optimizer state to a file periodically, resuming from it\nif the same compression is run again")
+	flags.DurationVar(&o.CheckpointEvery, "checkpointevery", time.Minute, "Interval between checkpoints")
+	flags.BoolVar(&o.BestMode, "best", false, "Try forward and backwards compression, keeping the smallest")
+	flags.Var((*memorySize)(&o.BlockSize), "blocks", "Split input into blocks of N bytes compressed separately,\nwritten in a block container")
+	flags.Var((*memorySize)(&o.BlockDictionary), "dict", "Let each block use the last N bytes of the previous one as\ndictionary, decompressing blocks in order")
+	flags.StringVar(&o.BestModes, "bestmodes", "v2,v1,backwards", "Comma-separated modes allowed by -best (v2, v1, backwards)")
+	flags.BoolVar(&o.VerifyMode, "verify", false, "Check that compressed data decompresses back to the input")
+	flags.BoolVar(&o.NoCache, "no-cache", false, "Always compress, without reading or writing the cache")
+}
+
+func (o *Options) memoryFlags(flags *flag.FlagSet) {
+	flags.Var((*memorySize)(&o.MaxMemory), "maxmem", "Limit optimizer memory to N bytes, or with suffix K, M or G,\nlimiting match lengths on large inputs")
+}
+
+func (o *Options) levelFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.QuickMode, "q", false, "Quick non-optimal compression")
+	flags.IntVar(&o.Level, "level", zx0.LEVEL_OPTIMAL, "Compression level from 1 (fastest) to 9 (optimal)")
+	for level := zx0.LEVEL_FASTEST; level <= zx0.LEVEL_OPTIMAL; level++ {
+		flags.Var(&levelFlag{&o.Level, level}, strconv.Itoa(level), fmt.Sprintf("Same as -level %d", level))
+	}
+}
+
+// level returns the compression level selected, quick compression replacing
+// the optimal levels, while the greedy and lazy ones are faster anyway.
+func (o *Options) level() int {
+	if o.QuickMode && o.Level > zx0.LEVEL_HEURISTIC {
+		return zx0.LEVEL_QUICK
+	}
+	return o.Level
+}
+
+// levelFlag is one of the flags "-1" to "-9", selecting a compression level.
+type levelFlag struct {
+	level *int
+	value int
+}
+
+func (l *levelFlag) String() string {
+	return "false"
+}
+
+func (l *levelFlag) Set(value string) error {
+	set, err := strconv.ParseBool(value)
+	if err == nil && set {
+		*l.level = l.value
+	}
+	return err
+}
+
+func (l *levelFlag) IsBoolFlag() bool {
+	return true
+}
+
+// memorySize is a flag value given in bytes, kilobytes, megabytes or
+// gigabytes, such as "512M".
+type memorySize int64
+
+func (m *memorySize) String() string {
+	return strconv.FormatInt(int64(*m), 10)
+}
+
+func (m *memorySize) Set(value string) error {
+	scale := int64(1)
+	switch strings.ToUpper(value[len(value)-min(len(value), 1):]) {
+	case "K":
+		scale = 1 << 10
+	case "M":
+		scale = 1 << 20
+	case "G":
+		scale = 1 << 30
+	}
+	if scale > 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid memory size")
+	}
+	*m = memorySize(size * scale)
+	return nil
+}
+
+func (o *Options) outputFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.ForcedMode, "f", false, "Force overwrite of output file")
+	flags.BoolVar(&o.StdoutMode, "stdout", false, "Write output to standard output")
+	flags.BoolVar(&o.BatchMode, "batch", false, "Process every input file, glob pattern or directory separately")
+	flags.BoolVar(&o.JsonMode, "json", false, "Report results as JSON records, one line per file")
+}
+
+func (o *Options) headerFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.AmsdosMode, "amsdos", false, "Strip AMSDOS header from input and regenerate it on output")
+	flags.BoolVar(&o.BloadMode, "bload", false, "Strip MSX BLOAD header from input and regenerate it on output")
+	flags.BoolVar(&o.Plus3dosMode, "plus3dos", false, "Strip +3DOS header from input and regenerate it on output")
+	flags.IntVar(&o.LoadAddress, "load", -1, "Load address for generated headers and ROMs")
+	flags.IntVar(&o.ExecAddress, "exec", -1, "Execution address for generated headers and ROMs")
+	flags.StringVar(&o.DskName, "dsk", "", "Also store output file on DSK disk image, creating it if needed")
+	flags.StringVar(&o.DskFormat, "dskfmt", formats.FORMAT_CPC_DATA.Name, "Format of new DSK disk images (data, system, plus3)")
+	flags.BoolVar(&o.DskExtended, "dskext", false, "Create new DSK disk images in extended format")
+	flags.StringVar(&o.TrdName, "trd", "", "Also store output file on TR-DOS TRD disk image, creating it if needed")
+	flags.StringVar(&o.SclName, "scl", "", "Also store output file on TR-DOS SCL disk image, creating it if needed")
+}
+
+func (o *Options) targetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.RomSize, "rom", "", "Build MSX ROM (16, 32 or auto) that unpacks to RAM on boot")
+	flags.BoolVar(&o.XexMode, "xex", false, "Compress Atari executable segments, unpacking each one as it's loaded")
+	flags.IntVar(&o.XexDecoder, "xexdec", formats.XEX_DEFAULT_DECODER, "Address of the 6502 decoder in compressed Atari executables")
+	flags.IntVar(&o.XexZeroPage, "xexzp", formats.XEX_DEFAULT_ZERO_PAGE, "Zero page address of the 11 bytes used by the 6502 decoder")
+	flags.BoolVar(&o.XexMerge, "xexmerge", false, "Merge contiguous Atari executable segments before compressing")
+}
+
+// Command is a subcommand of the command-line interface.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(arguments []string)
+}
+
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{"compress", "zx0 compress [options] input [output.zx0]",
+			"Compress a file, or a batch of files.", compressCommand},
+		{"decompress", "zx0 decompress [options] input.zx0 [output]",
+			"Decompress a file, or a batch of files.", decompressCommand},
+		{"info", "zx0 info [options] input.zx0...",
+			"Show information about compressed files.", infoCommand},
+		{"extract", "zx0 extract [options] input.zx0 output",
+			"Extract part of a block container, decompressing only the blocks needed.", extractCommand},
+		{"trace", "zx0 trace [options] input.zx0 | -encode input",
+			"Print every token of a compressed stream.", traceCommand},
+		{"heatmap", "zx0 heatmap [options] input [report.html]",
+			"Write an HTML report showing the compression cost of every byte.", heatmapCommand},
+		{"verify", "zx0 verify [options] input [input.zx0]",
+			"Check that a file survives a compression round trip.", verifyCommand},
+		{"bench", "zx0 bench [options] input... | pattern | directory",
+			"Compare compression modes and thread counts on a set of files.", benchCommand},
+		{"pack", "zx0 pack [options] manifest.yaml",
+			"Compress several files into a single archive.", pack},
+		{"cache", "zx0 cache [options] [info | prune | clear]",
+			"Show, prune or clear the cache of compressed outputs.", cacheCommand},
+		{"help", "zx0 help [command]",
+			"Show help about a command.", helpCommand},
+	}
+}
+
+func findCommand(name string) *Command {
+	for _, command := range commands {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+// newFlagSet creates the flag set of a command, printing its usage,
+// description and options on request.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		command := findCommand(name)
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\n%s\n", command.Usage, command.Description)
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(os.Stderr, "\nOptions:")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+func compressFlags(o *Options, flags *flag.FlagSet) {
+	o.compressionFlags(flags)
+	o.formatFlags(flags)
+	o.outputFlags(flags)
+	o.headerFlags(flags)
+	o.targetFlags(flags)
+}
+
+func decompressFlags(o *Options, flags *flag.FlagSet) {
+	o.Decompress = true
+	o.formatFlags(flags)
+	o.outputFlags(flags)
+	o.headerFlags(flags)
+}
+
+func legacyFlags(o *Options, flags *flag.FlagSet) {
+	o.compressionFlags(flags)
+	o.formatFlags(flags)
+	flags.BoolVar(&o.Decompress, "d", false, "Decompress")
+	o.outputFlags(flags)
+	o.headerFlags(flags)
+	o.targetFlags(flags)
+}
+
+func compressCommand(arguments []string) {
+	o, flags, config := parseOptions(func() *flag.FlagSet { return newFlagSet("compress") }, compressFlags, arguments)
+	process(o, config, flags.Args(), flags.Usage)
+}
+
+func decompressCommand(arguments []string) {
+	o, flags, config := parseOptions(func() *flag.FlagSet { return newFlagSet("decompress") }, decompressFlags, arguments)
+	process(o, config, flags.Args(), flags.Usage)
+}
+
+func helpCommand(arguments []string) {
+	if len(arguments) > 0 {
+		if command := findCommand(arguments[0]); command != nil && command.Name != "help" {
+			command.Run([]string{"-h"})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Error: Unknown command %s\n", arguments[0])
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Usage: zx0 <command> [options] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", command.Name, command.Description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun \"zx0 help <command>\" for the options of each command. The original")
+	fmt.Fprintln(os.Stderr, "syntax without a command is still supported:")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, LEGACY_USAGE)
+}
+
+const LEGACY_USAGE = "Usage: zx0 [-pN] [-f] [-c] [-b] [-q] [-1..-9] [-no-cache] [-d] [-stdout] [-amsdos] [-dsk image.dsk] [-bload] [-rom size] [-plus3dos] [-trd image.trd] [-scl image.scl] [-xex] input [output.zx0]\n" +
+	"       zx0 [options] [-batch] input... | pattern | directory"
+
+// legacy handles the original syntax, with all options in a single flag
+// set and decompression selected by "-d".
+func legacy(arguments []string) {
+	o, flags, config := parseOptions(func() *flag.FlagSet { return flag.NewFlagSet("zx0", flag.ExitOnError) }, legacyFlags, arguments)
+	process(o, config, flags.Args(), func() {
+		fmt.Fprintln(os.Stderr, LEGACY_USAGE)
+		fmt.Fprintln(os.Stderr, "\nRun \"zx0 help\" to list the available commands.")
+	})
+}
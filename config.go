@@ -0,0 +1,238 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configuration files searched from the working directory upward
+var CONFIG_FILES = []string{"zx0.toml", ".zx0rc"}
+
+// ConfigValue is an option set by a configuration file.
+type ConfigValue struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// ConfigOverride holds options applied to files matching a glob pattern.
+type ConfigOverride struct {
+	Pattern string
+	Values  []ConfigValue
+}
+
+// Config holds project-wide defaults for command-line options, written in a
+// small subset of TOML, with keys named after the options:
+//
+//	p = 8
+//	f = true
+//
+//	[files."*.scr"]
+//	b = true
+//
+// Patterns without a slash match file names in any directory, others match
+// paths relative to the directory of the configuration file. Compressed files
+// also match by the name of their decompressed contents, so "*.scr" applies
+// to "*.scr.zx0" too.
+type Config struct {
+	Path      string
+	Defaults  []ConfigValue
+	Overrides []ConfigOverride
+}
+
+// findConfig returns the first configuration file found in the working
+// directory or its parents, or nil if there is none.
+func findConfig() (*Config, error) {
+	directory, err := os.Getwd()
+	if err != nil {
+		return nil, nil
+	}
+	for {
+		for _, name := range CONFIG_FILES {
+			path := filepath.Join(directory, name)
+			if fileExists(path) {
+				return readConfig(path)
+			}
+		}
+		parent := filepath.Dir(directory)
+		if parent == directory {
+			return nil, nil
+		}
+		directory = parent
+	}
+}
+
+func readConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read config file %s", path)
+	}
+
+	// options are validated against the legacy syntax, which has them all
+	known := flag.NewFlagSet("config", flag.ContinueOnError)
+	legacyFlags(&Options{}, known)
+
+	config := &Config{Path: path}
+	values := &config.Defaults
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasPrefix(line, "[files.") || !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("Invalid section %s in config file %s, line %d", line, path, number+1)
+			}
+			pattern := unquote(strings.TrimSpace(line[len("[files.") : len(line)-1]))
+			if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, fmt.Errorf("Invalid pattern %s in config file %s, line %d", pattern, path, number+1)
+			}
+			config.Overrides = append(config.Overrides, ConfigOverride{Pattern: pattern})
+			values = &config.Overrides[len(config.Overrides)-1].Values
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || key == "" || value == "" {
+			return nil, fmt.Errorf("Expected key = value in config file %s, line %d", path, number+1)
+		}
+		key = strings.TrimLeft(unquote(key), "-")
+		if known.Lookup(key) == nil {
+			return nil, fmt.Errorf("Unknown option %s in config file %s, line %d", key, path, number+1)
+		}
+		if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+			value = unquote(value)
+		} else if value != "true" && value != "false" {
+			if _, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 0, 64); err != nil {
+				return nil, fmt.Errorf("Invalid value %s in config file %s, line %d", value, path, number+1)
+			}
+			value = strings.ReplaceAll(value, "_", "")
+		}
+		*values = append(*values, ConfigValue{key, value, number + 1})
+	}
+	return config, nil
+}
+
+// matches reports whether a file matches the pattern of an override, also
+// trying compressed files by the name of their decompressed contents.
+func (c *ConfigOverride) matches(config *Config, filename string) bool {
+	if trimmed := strings.TrimSuffix(filename, ".zx0"); trimmed != filename && c.matchesPath(config, trimmed) {
+		return true
+	}
+	return c.matchesPath(config, filename)
+}
+
+func (c *ConfigOverride) matchesPath(config *Config, filename string) bool {
+	if !strings.Contains(c.Pattern, "/") {
+		matched, _ := filepath.Match(c.Pattern, filepath.Base(filename))
+		return matched
+	}
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+	relative, err := filepath.Rel(filepath.Dir(config.Path), path)
+	if err != nil {
+		return false
+	}
+	matched, _ := filepath.Match(c.Pattern, filepath.ToSlash(relative))
+	return matched
+}
+
+// apply sets the defaults of the configuration on a flag set, followed by
+// the overrides matching the file given, if any. Options not supported by
+// the flag set are ignored.
+func (c *Config) apply(flags *flag.FlagSet, filename string) error {
+	values := append([]ConfigValue{}, c.Defaults...)
+	for _, override := range c.Overrides {
+		if filename != "" && override.matches(c, filename) {
+			values = append(values, override.Values...)
+		}
+	}
+	for _, value := range values {
+		if flags.Lookup(value.Key) == nil {
+			continue
+		}
+		if err := flags.Set(value.Key, value.Value); err != nil {
+			return fmt.Errorf("Invalid value %s for option %s in config file %s, line %d", value.Value, value.Key, c.Path, value.Line)
+		}
+	}
+	return nil
+}
+
+// fileConfig returns the options of a file, with the overrides of the
+// configuration file matching it applied.
+type fileConfig func(filename string) *Options
+
+// parseOptions parses the command-line arguments of a command on top of the
+// configuration file defaults, unless disabled by "-noconfig". The arguments
+// can be parsed again for a specific file with the fileConfig returned, so
+// the overrides of the configuration file matching it apply.
+func parseOptions(newFlags func() *flag.FlagSet, register func(*Options, *flag.FlagSet), arguments []string) (*Options, *flag.FlagSet, fileConfig) {
+	var config *Config
+	parse := func(filename string) (*Options, *flag.FlagSet) {
+		o := &Options{}
+		flags := newFlags()
+		register(o, flags)
+		flags.BoolVar(&o.NoConfig, "noconfig", false, "Ignore zx0.toml and .zx0rc configuration files")
+		if config != nil {
+			if err := config.apply(flags, filename); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		flags.Parse(arguments)
+		return o, flags
+	}
+
+	o, flags := parse("")
+	same := func(filename string) *Options {
+		return o
+	}
+	if o.NoConfig {
+		return o, flags, same
+	}
+	config, err := findConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if config == nil {
+		return o, flags, same
+	}
+	o, flags = parse("")
+	return o, flags, func(filename string) *Options {
+		fileOptions, _ := parse(filename)
+		return fileOptions
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// extractCommand writes part of the decompressed data of a block container,
+// decompressing only the blocks needed.
+func extractCommand(arguments []string) {
+	var offset, length int64
+	var forcedMode bool
+	flags := newFlagSet("extract")
+	flags.Int64Var(&offset, "offset", 0, "Start of the data extracted, within the decompressed data")
+	flags.Int64Var(&length, "length", -1, "Number of bytes extracted, up to the end by default")
+	flags.BoolVar(&forcedMode, "f", false, "Force overwrite of output file")
+	flags.Parse(arguments)
+	if flags.NArg() != 2 || offset < 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	inputName, outputName := flags.Arg(0), flags.Arg(1)
+
+	var input io.ReaderAt
+	var size int64
+	if inputName == "-" {
+		data, err := readFile(inputName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", inputName)
+			os.Exit(1)
+		}
+		input, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		file, err := os.Open(inputName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", inputName)
+			os.Exit(1)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", inputName)
+			os.Exit(1)
+		}
+		input, size = file, info.Size()
+	}
+
+	reader, err := zx0.NewContainerReader(input, size)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid input file %s (%v)\n", inputName, err)
+		os.Exit(1)
+	}
+	if length < 0 {
+		length = max(reader.Size()-offset, 0)
+	}
+	if offset+length > reader.Size() {
+		fmt.Fprintf(os.Stderr, "Error: Range exceeds the decompressed size of %d bytes\n", reader.Size())
+		os.Exit(1)
+	}
+	if !forcedMode && outputName != "-" && fileExists(outputName) {
+		fmt.Fprintf(os.Stderr, "Error: Already existing output file %s\n", outputName)
+		os.Exit(1)
+	}
+
+	// read as much as decompressed, rather than trusting the size in the header
+	output, err := io.ReadAll(io.NewSectionReader(reader, offset, length))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid input file %s (%v)\n", inputName, err)
+		os.Exit(1)
+	}
+	if err := writeFile(outputName, output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", outputName)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Extracted %d bytes from offset %d!\n", length, offset)
+}
@@ -0,0 +1,170 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	AMSDOS_HEADER_SIZE = 128
+
+	AMSDOS_TYPE_BASIC     = 0
+	AMSDOS_TYPE_PROTECTED = 1
+	AMSDOS_TYPE_BINARY    = 2
+)
+
+// AmsdosHeader is the 128-byte header AMSDOS places in front of every
+// BASIC and binary file stored on an Amstrad CPC disk.
+type AmsdosHeader struct {
+	User        byte
+	Name        string
+	Extension   string
+	FileType    byte
+	LoadAddress int
+	Length      int
+	ExecAddress int
+}
+
+func amsdosChecksum(data []byte) int {
+	sum := 0
+	for _, b := range data[:67] {
+		sum += int(b)
+	}
+	return sum & 0xffff
+}
+
+// ParseAmsdosHeader returns the AMSDOS header found at the start of data,
+// or nil if data does not begin with a header with a valid checksum.
+func ParseAmsdosHeader(data []byte) *AmsdosHeader {
+	if len(data) < AMSDOS_HEADER_SIZE {
+		return nil
+	}
+	if amsdosChecksum(data) != int(data[67])|int(data[68])<<8 {
+		return nil
+	}
+	// a zero-filled block has a valid checksum too, but is not a header
+	if amsdosChecksum(data) == 0 {
+		return nil
+	}
+	return &AmsdosHeader{
+		User:        data[0],
+		Name:        strings.TrimRight(string(data[1:9]), " "),
+		Extension:   strings.TrimRight(string(data[9:12]), " "),
+		FileType:    data[18],
+		LoadAddress: int(data[21]) | int(data[22])<<8,
+		Length:      int(data[64]) | int(data[65])<<8 | int(data[66])<<16,
+		ExecAddress: int(data[26]) | int(data[27])<<8,
+	}
+}
+
+// StripAmsdosHeader splits data into its AMSDOS header and the file contents
+// following it. The header is nil if data has no valid AMSDOS header.
+func StripAmsdosHeader(data []byte) (*AmsdosHeader, []byte) {
+	header := ParseAmsdosHeader(data)
+	if header == nil {
+		return nil, data
+	}
+	body := data[AMSDOS_HEADER_SIZE:]
+	if header.Length < len(body) {
+		// drop the padding up to the end of the last 128-byte record
+		body = body[:header.Length]
+	}
+	return header, body
+}
+
+// NewAmsdosHeader creates a binary file header, deriving the 8.3 filename
+// from the given path.
+func NewAmsdosHeader(filename string, loadAddress, execAddress, length int) *AmsdosHeader {
+	name, extension := SplitFilename83(filename)
+	return &AmsdosHeader{
+		Name:        name,
+		Extension:   extension,
+		FileType:    AMSDOS_TYPE_BINARY,
+		LoadAddress: loadAddress,
+		Length:      length,
+		ExecAddress: execAddress,
+	}
+}
+
+// Bytes serializes the header, computing its checksum.
+func (h *AmsdosHeader) Bytes() []byte {
+	header := make([]byte, AMSDOS_HEADER_SIZE)
+	header[0] = h.User
+	copy(header[1:12], padFilename83(h.Name, h.Extension))
+	header[18] = h.FileType
+	header[21] = byte(h.LoadAddress)
+	header[22] = byte(h.LoadAddress >> 8)
+	header[24] = byte(h.Length)
+	header[25] = byte(h.Length >> 8)
+	header[26] = byte(h.ExecAddress)
+	header[27] = byte(h.ExecAddress >> 8)
+	header[64] = byte(h.Length)
+	header[65] = byte(h.Length >> 8)
+	header[66] = byte(h.Length >> 16)
+	checksum := amsdosChecksum(header)
+	header[67] = byte(checksum)
+	header[68] = byte(checksum >> 8)
+	return header
+}
+
+// Wrap returns data prefixed with the header, updating the header length to
+// match the data.
+func (h *AmsdosHeader) Wrap(data []byte) []byte {
+	h.Length = len(data)
+	return append(h.Bytes(), data...)
+}
+
+// SplitFilename83 converts a path into an upper case CP/M style 8.3 name.
+func SplitFilename83(filename string) (string, string) {
+	base := filepath.Base(filename)
+	extension := filepath.Ext(base)
+	name := strings.TrimSuffix(base, extension)
+	extension = strings.TrimPrefix(extension, ".")
+	return sanitizeFilename(name, 8), sanitizeFilename(extension, 3)
+}
+
+func sanitizeFilename(s string, size int) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if sb.Len() == size {
+			break
+		}
+		if r <= ' ' || r > '~' || strings.ContainsRune(`.,;:=?*[]<>|"/\`, r) {
+			r = '_'
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func padFilename83(name, extension string) []byte {
+	padded := []byte("           ")
+	copy(padded[0:8], name)
+	copy(padded[8:11], extension)
+	return padded
+}
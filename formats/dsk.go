@@ -0,0 +1,478 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	DSK_STANDARD_SIGNATURE = "MV - CPCEMU Disk-File\r\nDisk-Info\r\n"
+	DSK_EXTENDED_SIGNATURE = "EXTENDED CPC DSK File\r\nDisk-Info\r\n"
+	DSK_TRACK_SIGNATURE    = "Track-Info\r\n"
+	DSK_CREATOR            = "zx0-go"
+	DSK_HEADER_SIZE        = 256
+	DSK_TRACK_HEADER_SIZE  = 256
+
+	CPM_DIR_ENTRY_SIZE = 32
+	CPM_RECORD_SIZE    = 128
+	CPM_DELETED        = 0xe5
+)
+
+// DskFormat describes the geometry and CP/M filesystem parameters of a disk.
+type DskFormat struct {
+	Name            string
+	Tracks          int
+	Sides           int
+	SectorsPerTrack int
+	SectorSize      int
+	FirstSectorID   byte
+	ReservedTracks  int
+	BlockSize       int
+	DirEntries      int
+	Gap3            byte
+	DiscSpec        bool
+}
+
+var (
+	// FORMAT_CPC_DATA is the AMSDOS DATA format, with no reserved tracks.
+	FORMAT_CPC_DATA = DskFormat{"data", 40, 1, 9, 512, 0xc1, 0, 1024, 64, 0x4e, false}
+
+	// FORMAT_CPC_SYSTEM is the AMSDOS SYSTEM format, with two reserved tracks.
+	FORMAT_CPC_SYSTEM = DskFormat{"system", 40, 1, 9, 512, 0x41, 2, 1024, 64, 0x4e, false}
+
+	// FORMAT_PLUS3 is the Spectrum +3 format, with one reserved track holding
+	// the disc specification in its first sector.
+	FORMAT_PLUS3 = DskFormat{"plus3", 40, 1, 9, 512, 0x01, 1, 1024, 64, 0x52, true}
+
+	DSK_FORMATS = []DskFormat{FORMAT_CPC_DATA, FORMAT_CPC_SYSTEM, FORMAT_PLUS3}
+)
+
+// FindDskFormat looks up a disk format by name.
+func FindDskFormat(name string) (DskFormat, error) {
+	for _, format := range DSK_FORMATS {
+		if format.Name == name {
+			return format, nil
+		}
+	}
+	return DskFormat{}, fmt.Errorf("Unknown disk format %s", name)
+}
+
+func (f DskFormat) sizeCode() byte {
+	n := byte(0)
+	for size := f.SectorSize; size > 128; size >>= 1 {
+		n++
+	}
+	return n
+}
+
+// discSpec returns the +3DOS disc specification describing the format.
+func (f DskFormat) discSpec() []byte {
+	spec := make([]byte, 16)
+	spec[1] = byte(f.Sides - 1)
+	spec[2] = byte(f.Tracks)
+	spec[3] = byte(f.SectorsPerTrack)
+	spec[4] = f.sizeCode()
+	spec[5] = byte(f.ReservedTracks)
+	for size := f.BlockSize; size > 128; size >>= 1 {
+		spec[6]++
+	}
+	spec[7] = byte(f.dirBlocks())
+	spec[8] = 0x2a
+	spec[9] = f.Gap3
+	return spec
+}
+
+func (f DskFormat) totalBlocks() int {
+	return (f.Tracks*f.Sides - f.ReservedTracks) * f.SectorsPerTrack * f.SectorSize / f.BlockSize
+}
+
+func (f DskFormat) dirBlocks() int {
+	return (f.DirEntries*CPM_DIR_ENTRY_SIZE + f.BlockSize - 1) / f.BlockSize
+}
+
+type dskSector struct {
+	track, side, id, size byte
+	data                  []byte
+}
+
+type dskTrack struct {
+	track, side byte
+	sectors     []*dskSector
+}
+
+// DskImage is an in-memory CPCEMU disk image holding a CP/M filesystem.
+type DskImage struct {
+	Format   DskFormat
+	Extended bool
+	tracks   []*dskTrack
+}
+
+// NewDskImage creates a freshly formatted, empty disk image.
+func NewDskImage(format DskFormat, extended bool) *DskImage {
+	d := &DskImage{Format: format, Extended: extended}
+	for cylinder := 0; cylinder < format.Tracks; cylinder++ {
+		for side := 0; side < format.Sides; side++ {
+			track := &dskTrack{track: byte(cylinder), side: byte(side)}
+			for i := 0; i < format.SectorsPerTrack; i++ {
+				track.sectors = append(track.sectors, &dskSector{
+					track: byte(cylinder),
+					side:  byte(side),
+					id:    format.FirstSectorID + byte(i),
+					size:  format.sizeCode(),
+					data:  bytes.Repeat([]byte{CPM_DELETED}, format.SectorSize),
+				})
+			}
+			d.tracks = append(d.tracks, track)
+		}
+	}
+	if format.DiscSpec {
+		copy(d.tracks[0].sectors[0].data, format.discSpec())
+	}
+	return d
+}
+
+// ParseDskImage loads a standard or extended disk image, detecting the
+// filesystem format from the sector IDs of the first track.
+func ParseDskImage(data []byte) (*DskImage, error) {
+	d := &DskImage{}
+	switch {
+	case bytes.HasPrefix(data, []byte(DSK_STANDARD_SIGNATURE[:8])):
+	case bytes.HasPrefix(data, []byte(DSK_EXTENDED_SIGNATURE[:8])):
+		d.Extended = true
+	default:
+		return nil, fmt.Errorf("Not a DSK image")
+	}
+	if len(data) < DSK_HEADER_SIZE {
+		return nil, fmt.Errorf("Truncated DSK image")
+	}
+
+	trackCount := int(data[0x30]) * int(data[0x31])
+	if d.Extended && 0x34+trackCount > DSK_HEADER_SIZE {
+		return nil, fmt.Errorf("Too many tracks in DSK image")
+	}
+	position := DSK_HEADER_SIZE
+	for i := 0; i < trackCount; i++ {
+		trackSize := int(data[0x32]) | int(data[0x33])<<8
+		if d.Extended {
+			trackSize = int(data[0x34+i]) << 8
+		}
+		if trackSize == 0 {
+			// unformatted track
+			d.tracks = append(d.tracks, &dskTrack{})
+			continue
+		}
+		if trackSize < DSK_TRACK_HEADER_SIZE || position+trackSize > len(data) ||
+			!bytes.HasPrefix(data[position:], []byte(DSK_TRACK_SIGNATURE)) {
+			return nil, fmt.Errorf("Invalid track %d in DSK image", i)
+		}
+		info := data[position : position+DSK_TRACK_HEADER_SIZE]
+		trackEnd := position + trackSize
+		sectorCount := int(info[0x15])
+		if 0x18+sectorCount*8 > DSK_TRACK_HEADER_SIZE || (!d.Extended && info[0x14] > 6) {
+			return nil, fmt.Errorf("Invalid sectors on track %d in DSK image", i)
+		}
+		track := &dskTrack{track: info[0x10], side: info[0x11]}
+		sectorPosition := position + DSK_TRACK_HEADER_SIZE
+		for j := 0; j < sectorCount; j++ {
+			sectorInfo := info[0x18+j*8:]
+			size := 128 << info[0x14]
+			if d.Extended {
+				size = int(sectorInfo[6]) | int(sectorInfo[7])<<8
+			}
+			// sectors must be within their track
+			if sectorPosition+size > trackEnd {
+				return nil, fmt.Errorf("Truncated sector in DSK image")
+			}
+			track.sectors = append(track.sectors, &dskSector{
+				track: sectorInfo[0],
+				side:  sectorInfo[1],
+				id:    sectorInfo[2],
+				size:  sectorInfo[3],
+				data:  append([]byte{}, data[sectorPosition:sectorPosition+size]...),
+			})
+			sectorPosition += size
+		}
+		d.tracks = append(d.tracks, track)
+		position = trackEnd
+	}
+
+	if len(d.tracks) == 0 || len(d.tracks[0].sectors) == 0 {
+		return nil, fmt.Errorf("Unformatted DSK image")
+	}
+	firstID := d.tracks[0].sectors[0].id
+	for _, sector := range d.tracks[0].sectors {
+		firstID = min(firstID, sector.id)
+	}
+	for _, format := range DSK_FORMATS {
+		if format.FirstSectorID == firstID {
+			d.Format = format
+			d.Format.Tracks = int(data[0x30])
+			d.Format.Sides = int(data[0x31])
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("Unsupported DSK format with first sector ID 0x%02X", firstID)
+}
+
+// Bytes serializes the disk image.
+func (d *DskImage) Bytes() []byte {
+	header := make([]byte, DSK_HEADER_SIZE)
+	if d.Extended {
+		copy(header, DSK_EXTENDED_SIGNATURE)
+	} else {
+		copy(header, DSK_STANDARD_SIGNATURE)
+	}
+	copy(header[0x22:0x30], DSK_CREATOR)
+	header[0x30] = byte(d.Format.Tracks)
+	header[0x31] = byte(d.Format.Sides)
+
+	var body []byte
+	maxTrackSize := 0
+	for i, track := range d.tracks {
+		trackData := d.trackBytes(track)
+		maxTrackSize = max(maxTrackSize, len(trackData))
+		if d.Extended {
+			header[0x34+i] = byte(len(trackData) >> 8)
+		}
+		body = append(body, trackData...)
+	}
+	if !d.Extended {
+		header[0x32] = byte(maxTrackSize)
+		header[0x33] = byte(maxTrackSize >> 8)
+	}
+	return append(header, body...)
+}
+
+func (d *DskImage) trackBytes(track *dskTrack) []byte {
+	if len(track.sectors) == 0 {
+		return nil
+	}
+	info := make([]byte, DSK_TRACK_HEADER_SIZE)
+	copy(info, DSK_TRACK_SIGNATURE)
+	info[0x10] = track.track
+	info[0x11] = track.side
+	info[0x14] = d.Format.sizeCode()
+	info[0x15] = byte(len(track.sectors))
+	info[0x16] = d.Format.Gap3
+	info[0x17] = CPM_DELETED
+	for i, sector := range track.sectors {
+		sectorInfo := info[0x18+i*8:]
+		sectorInfo[0] = sector.track
+		sectorInfo[1] = sector.side
+		sectorInfo[2] = sector.id
+		sectorInfo[3] = sector.size
+		if d.Extended {
+			sectorInfo[6] = byte(len(sector.data))
+			sectorInfo[7] = byte(len(sector.data) >> 8)
+		}
+	}
+	data := info
+	for _, sector := range track.sectors {
+		data = append(data, sector.data...)
+	}
+	return data
+}
+
+// sector returns the data of the n-th logical sector of the CP/M data area,
+// which starts after the reserved tracks.
+func (d *DskImage) sector(n int) ([]byte, error) {
+	trackIndex := d.Format.ReservedTracks + n/d.Format.SectorsPerTrack
+	id := d.Format.FirstSectorID + byte(n%d.Format.SectorsPerTrack)
+	if trackIndex >= len(d.tracks) {
+		return nil, fmt.Errorf("Sector %d beyond end of disk", n)
+	}
+	for _, sector := range d.tracks[trackIndex].sectors {
+		if sector.id == id && len(sector.data) == d.Format.SectorSize {
+			return sector.data, nil
+		}
+	}
+	return nil, fmt.Errorf("Missing sector 0x%02X on track %d", id, trackIndex)
+}
+
+func (d *DskImage) readBlock(block int) ([]byte, error) {
+	sectorsPerBlock := d.Format.BlockSize / d.Format.SectorSize
+	data := []byte{}
+	for i := 0; i < sectorsPerBlock; i++ {
+		sector, err := d.sector(block*sectorsPerBlock + i)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, sector...)
+	}
+	return data, nil
+}
+
+func (d *DskImage) writeBlock(block int, data []byte) error {
+	sectorsPerBlock := d.Format.BlockSize / d.Format.SectorSize
+	for i := 0; i < sectorsPerBlock; i++ {
+		sector, err := d.sector(block*sectorsPerBlock + i)
+		if err != nil {
+			return err
+		}
+		copy(sector, data[i*d.Format.SectorSize:])
+	}
+	return nil
+}
+
+func (d *DskImage) directory() ([]byte, error) {
+	directory := []byte{}
+	for block := 0; block < d.Format.dirBlocks(); block++ {
+		data, err := d.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		directory = append(directory, data...)
+	}
+	return directory[:d.Format.DirEntries*CPM_DIR_ENTRY_SIZE], nil
+}
+
+func (d *DskImage) writeDirectory(directory []byte) error {
+	for block := 0; block < d.Format.dirBlocks(); block++ {
+		data := make([]byte, d.Format.BlockSize)
+		copy(data, directory[block*d.Format.BlockSize:])
+		if err := d.writeBlock(block, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DskImage) findEntries(directory []byte, name, extension string) []int {
+	entries := []int{}
+	key := padFilename83(name, extension)
+	for i := 0; i < len(directory); i += CPM_DIR_ENTRY_SIZE {
+		if directory[i] == CPM_DELETED {
+			continue
+		}
+		// ignore the attribute bits stored in the top bit of each character
+		match := true
+		for j := 0; j < 11; j++ {
+			if directory[i+1+j]&0x7f != key[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			entries = append(entries, i)
+		}
+	}
+	return entries
+}
+
+// HasFile reports whether a file with the given path's 8.3 name exists.
+func (d *DskImage) HasFile(filename string) (bool, error) {
+	directory, err := d.directory()
+	if err != nil {
+		return false, err
+	}
+	name, extension := SplitFilename83(filename)
+	return len(d.findEntries(directory, name, extension)) > 0, nil
+}
+
+// RemoveFile deletes all directory entries of the file, releasing its blocks.
+func (d *DskImage) RemoveFile(filename string) error {
+	directory, err := d.directory()
+	if err != nil {
+		return err
+	}
+	name, extension := SplitFilename83(filename)
+	for _, entry := range d.findEntries(directory, name, extension) {
+		directory[entry] = CPM_DELETED
+	}
+	return d.writeDirectory(directory)
+}
+
+// AddFile stores data as a new file in user area 0, using the 8.3 name
+// derived from the given path.
+func (d *DskImage) AddFile(filename string, data []byte) error {
+	directory, err := d.directory()
+	if err != nil {
+		return err
+	}
+	name, extension := SplitFilename83(filename)
+	if len(d.findEntries(directory, name, extension)) > 0 {
+		return fmt.Errorf("File %s.%s already exists in disk image", name, extension)
+	}
+
+	// collect free blocks and directory entries
+	used := make([]bool, d.Format.totalBlocks())
+	for block := 0; block < d.Format.dirBlocks(); block++ {
+		used[block] = true
+	}
+	freeEntries := []int{}
+	for i := 0; i < len(directory); i += CPM_DIR_ENTRY_SIZE {
+		if directory[i] == CPM_DELETED {
+			freeEntries = append(freeEntries, i)
+			continue
+		}
+		for _, block := range directory[i+16 : i+32] {
+			if int(block) < len(used) {
+				used[block] = true
+			}
+		}
+	}
+	freeBlocks := []int{}
+	for block, inUse := range used {
+		if !inUse {
+			freeBlocks = append(freeBlocks, block)
+		}
+	}
+
+	blocksNeeded := (len(data) + d.Format.BlockSize - 1) / d.Format.BlockSize
+	blocksPerEntry := 16
+	extentSize := blocksPerEntry * d.Format.BlockSize
+	entriesNeeded := max((len(data)+extentSize-1)/extentSize, 1)
+	if blocksNeeded > len(freeBlocks) {
+		return fmt.Errorf("Not enough space in disk image (%d bytes free)", len(freeBlocks)*d.Format.BlockSize)
+	}
+	if entriesNeeded > len(freeEntries) {
+		return fmt.Errorf("Disk image directory is full")
+	}
+
+	key := padFilename83(name, extension)
+	for extent := 0; extent < entriesNeeded; extent++ {
+		entry := directory[freeEntries[extent] : freeEntries[extent]+CPM_DIR_ENTRY_SIZE]
+		clear(entry)
+		copy(entry[1:12], key)
+		chunk := data[min(extent*extentSize, len(data)):min((extent+1)*extentSize, len(data))]
+		entry[12] = byte(extent & 0x1f)
+		entry[14] = byte(extent >> 5)
+		entry[15] = byte((len(chunk) + CPM_RECORD_SIZE - 1) / CPM_RECORD_SIZE)
+		for i := 0; i*d.Format.BlockSize < len(chunk); i++ {
+			block := freeBlocks[0]
+			freeBlocks = freeBlocks[1:]
+			entry[16+i] = byte(block)
+			blockData := bytes.Repeat([]byte{0x1a}, d.Format.BlockSize)
+			copy(blockData, chunk[i*d.Format.BlockSize:])
+			if err := d.writeBlock(block, blockData); err != nil {
+				return err
+			}
+		}
+	}
+	return d.writeDirectory(directory)
+}
@@ -0,0 +1,112 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import "testing"
+
+// testDskImage returns a freshly formatted image, standard or extended.
+func testDskImage(extended bool) []byte {
+	return NewDskImage(FORMAT_CPC_DATA, extended).Bytes()
+}
+
+func TestParseDskImage(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		image, err := ParseDskImage(testDskImage(extended))
+		if err != nil {
+			t.Fatalf("extended %v: %v", extended, err)
+		}
+		if image.Format.Name != FORMAT_CPC_DATA.Name || image.Extended != extended || len(image.tracks) != FORMAT_CPC_DATA.Tracks {
+			t.Errorf("extended %v: parsed as %s, extended %v, %d tracks", extended, image.Format.Name, image.Extended, len(image.tracks))
+		}
+	}
+}
+
+func TestParseTruncatedDskImage(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		data := testDskImage(extended)
+		for size := 8; size < len(data); size += 97 {
+			if _, err := ParseDskImage(data[:size]); err == nil {
+				t.Errorf("extended %v: image truncated to %d bytes accepted", extended, size)
+			}
+		}
+	}
+}
+
+func TestParseMalformedDskImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		extended bool
+		size     int
+		change   func(data []byte)
+	}{
+		{"too many tracks", true, 0, func(data []byte) {
+			data[0x30], data[0x31] = 255, 2
+		}},
+		{"too many unformatted tracks", true, DSK_HEADER_SIZE, func(data []byte) {
+			data[0x30], data[0x31] = 255, 2
+			clear(data[0x34:])
+		}},
+		{"track smaller than its header", false, 0, func(data []byte) {
+			data[0x32], data[0x33] = 0x10, 0
+		}},
+		{"extended track holding only its header", true, 0, func(data []byte) {
+			data[0x34] = 1
+		}},
+		{"track too large", false, 0, func(data []byte) {
+			data[0x32], data[0x33] = 0xff, 0xff
+		}},
+		{"missing track signature", false, 0, func(data []byte) {
+			data[DSK_HEADER_SIZE] = 'X'
+		}},
+		{"too many sectors", false, 0, func(data []byte) {
+			data[DSK_HEADER_SIZE+0x15] = 255
+		}},
+		{"too many empty sectors", true, DSK_HEADER_SIZE + DSK_TRACK_HEADER_SIZE, func(data []byte) {
+			data[0x30], data[0x34] = 1, 1
+			clear(data[DSK_HEADER_SIZE+0x18:])
+			data[DSK_HEADER_SIZE+0x15] = 255
+		}},
+		{"sector size code too large", false, 0, func(data []byte) {
+			data[DSK_HEADER_SIZE+0x14] = 255
+		}},
+		{"sector beyond its track", false, 0, func(data []byte) {
+			data[DSK_HEADER_SIZE+0x14] = 6
+		}},
+		{"extended sector beyond its track", true, 0, func(data []byte) {
+			data[DSK_HEADER_SIZE+0x18+6], data[DSK_HEADER_SIZE+0x18+7] = 0xff, 0xff
+		}},
+	}
+	for _, test := range tests {
+		data := testDskImage(test.extended)
+		if test.size > 0 {
+			data = data[:test.size]
+		}
+		test.change(data)
+		if _, err := ParseDskImage(data); err == nil {
+			t.Errorf("%s: malformed image accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+// A forward ZX0 (v2) decoder for the 6502, assembled at address 0 and with
+// its zero page variables starting at address 0:
+//
+//	bits = zp+0, src = zp+1, dst = zp+3, len = zp+5, off = zp+7, ptr = zp+9
+//
+// Store the compressed data address in src and the destination address in
+// dst, then call decode. Registers and flags are not preserved.
+//
+//	0000  A0 00     decode:   ldy #0
+//	0002  A2 00               ldx #0
+//	0004  A9 80               lda #$80
+//	0006  85 00               sta bits
+//	0008  A9 01               lda #1
+//	000A  85 07               sta off
+//	000C  84 08               sty off+1
+//	000E  20 A3 00  literals: jsr gamma
+//	0011  B1 01     lcopy:    lda (src),y
+//	0013  91 03               sta (dst),y
+//	0015  E6 01               inc src
+//	0017  D0 02               bne l1
+//	0019  E6 02               inc src+1
+//	001B  E6 03     l1:       inc dst
+//	001D  D0 02               bne l2
+//	001F  E6 04               inc dst+1
+//	0021  20 96 00  l2:       jsr declen
+//	0024  D0 EB               bne lcopy
+//	0026  20 C0 00            jsr getbit
+//	0029  B0 0B               bcs newoff
+//	002B  20 A3 00            jsr gamma
+//	002E  20 73 00            jsr copy
+//	0031  20 C0 00            jsr getbit
+//	0034  90 D8               bcc literals
+//	0036  A2 01     newoff:   ldx #1
+//	0038  20 A3 00            jsr gamma
+//	003B  A2 00               ldx #0
+//	003D  A5 06               lda len+1
+//	003F  D0 31               bne done
+//	0041  B1 01               lda (src),y
+//	0043  E6 01               inc src
+//	0045  D0 02               bne n1
+//	0047  E6 02               inc src+1
+//	0049  4A        n1:       lsr a
+//	004A  08                  php
+//	004B  85 09               sta ptr
+//	004D  A5 05               lda len
+//	004F  4A                  lsr a
+//	0050  85 08               sta off+1
+//	0052  A9 00               lda #0
+//	0054  6A                  ror a
+//	0055  38                  sec
+//	0056  E5 09               sbc ptr
+//	0058  85 07               sta off
+//	005A  B0 02               bcs n2
+//	005C  C6 08               dec off+1
+//	005E  28        n2:       plp
+//	005F  20 A6 00            jsr gammac
+//	0062  E6 05               inc len
+//	0064  D0 02               bne n3
+//	0066  E6 06               inc len+1
+//	0068  20 73 00  n3:       jsr copy
+//	006B  20 C0 00            jsr getbit
+//	006E  90 9E               bcc literals
+//	0070  B0 C4               bcs newoff
+//	0072  60        done:     rts
+//	0073  38        copy:     sec
+//	0074  A5 03               lda dst
+//	0076  E5 07               sbc off
+//	0078  85 09               sta ptr
+//	007A  A5 04               lda dst+1
+//	007C  E5 08               sbc off+1
+//	007E  85 0A               sta ptr+1
+//	0080  B1 09     c1:       lda (ptr),y
+//	0082  91 03               sta (dst),y
+//	0084  E6 09               inc ptr
+//	0086  D0 02               bne c2
+//	0088  E6 0A               inc ptr+1
+//	008A  E6 03     c2:       inc dst
+//	008C  D0 02               bne c3
+//	008E  E6 04               inc dst+1
+//	0090  20 96 00  c3:       jsr declen
+//	0093  D0 EB               bne c1
+//	0095  60                  rts
+//	0096  A5 05     declen:   lda len
+//	0098  D0 02               bne d1
+//	009A  C6 06               dec len+1
+//	009C  C6 05     d1:       dec len
+//	009E  A5 05               lda len
+//	00A0  05 06               ora len+1
+//	00A2  60                  rts
+//	00A3  20 C0 00  gamma:    jsr getbit
+//	00A6  A9 01     gammac:   lda #1
+//	00A8  85 05               sta len
+//	00AA  84 06               sty len+1
+//	00AC  B0 11               bcs g2
+//	00AE  20 C0 00  g1:       jsr getbit
+//	00B1  26 05               rol len
+//	00B3  26 06               rol len+1
+//	00B5  8A                  txa
+//	00B6  45 05               eor len
+//	00B8  85 05               sta len
+//	00BA  20 C0 00            jsr getbit
+//	00BD  90 EF               bcc g1
+//	00BF  60        g2:       rts
+//	00C0  06 00     getbit:   asl bits
+//	00C2  D0 0B               bne b2
+//	00C4  B1 01               lda (src),y
+//	00C6  E6 01               inc src
+//	00C8  D0 02               bne b1
+//	00CA  E6 02               inc src+1
+//	00CC  2A        b1:       rol a
+//	00CD  85 00               sta bits
+//	00CF  60        b2:       rts
+var dzx0Mos6502 = []byte{
+	0xa0, 0x00, 0xa2, 0x00, 0xa9, 0x80, 0x85, 0x00, 0xa9, 0x01, 0x85, 0x07,
+	0x84, 0x08, 0x20, 0xa3, 0x00, 0xb1, 0x01, 0x91, 0x03, 0xe6, 0x01, 0xd0,
+	0x02, 0xe6, 0x02, 0xe6, 0x03, 0xd0, 0x02, 0xe6, 0x04, 0x20, 0x96, 0x00,
+	0xd0, 0xeb, 0x20, 0xc0, 0x00, 0xb0, 0x0b, 0x20, 0xa3, 0x00, 0x20, 0x73,
+	0x00, 0x20, 0xc0, 0x00, 0x90, 0xd8, 0xa2, 0x01, 0x20, 0xa3, 0x00, 0xa2,
+	0x00, 0xa5, 0x06, 0xd0, 0x31, 0xb1, 0x01, 0xe6, 0x01, 0xd0, 0x02, 0xe6,
+	0x02, 0x4a, 0x08, 0x85, 0x09, 0xa5, 0x05, 0x4a, 0x85, 0x08, 0xa9, 0x00,
+	0x6a, 0x38, 0xe5, 0x09, 0x85, 0x07, 0xb0, 0x02, 0xc6, 0x08, 0x28, 0x20,
+	0xa6, 0x00, 0xe6, 0x05, 0xd0, 0x02, 0xe6, 0x06, 0x20, 0x73, 0x00, 0x20,
+	0xc0, 0x00, 0x90, 0x9e, 0xb0, 0xc4, 0x60, 0x38, 0xa5, 0x03, 0xe5, 0x07,
+	0x85, 0x09, 0xa5, 0x04, 0xe5, 0x08, 0x85, 0x0a, 0xb1, 0x09, 0x91, 0x03,
+	0xe6, 0x09, 0xd0, 0x02, 0xe6, 0x0a, 0xe6, 0x03, 0xd0, 0x02, 0xe6, 0x04,
+	0x20, 0x96, 0x00, 0xd0, 0xeb, 0x60, 0xa5, 0x05, 0xd0, 0x02, 0xc6, 0x06,
+	0xc6, 0x05, 0xa5, 0x05, 0x05, 0x06, 0x60, 0x20, 0xc0, 0x00, 0xa9, 0x01,
+	0x85, 0x05, 0x84, 0x06, 0xb0, 0x11, 0x20, 0xc0, 0x00, 0x26, 0x05, 0x26,
+	0x06, 0x8a, 0x45, 0x05, 0x85, 0x05, 0x20, 0xc0, 0x00, 0x90, 0xef, 0x60,
+	0x06, 0x00, 0xd0, 0x0b, 0xb1, 0x01, 0xe6, 0x01, 0xd0, 0x02, 0xe6, 0x02,
+	0x2a, 0x85, 0x00, 0x60,
+}
+
+// offsets of the absolute JSR targets within dzx0Mos6502
+var dzx0Mos6502Relocations = []int{
+	0x0f, 0x22, 0x27, 0x2c, 0x2f, 0x32, 0x39, 0x60, 0x69, 0x6c, 0x91,
+	0xa4, 0xaf, 0xbb,
+}
+
+// offsets of the zero page operands within dzx0Mos6502
+var dzx0Mos6502ZeroPage = []int{
+	0x07, 0x0b, 0x0d, 0x12, 0x14, 0x16, 0x1a, 0x1c, 0x20, 0x3e, 0x42,
+	0x44, 0x48, 0x4c, 0x4e, 0x51, 0x57, 0x59, 0x5d, 0x63, 0x67, 0x75,
+	0x77, 0x79, 0x7b, 0x7d, 0x7f, 0x81, 0x83, 0x85, 0x89, 0x8b, 0x8f,
+	0x97, 0x9b, 0x9d, 0x9f, 0xa1, 0xa9, 0xab, 0xb2, 0xb4, 0xb7, 0xb9,
+	0xc1, 0xc5, 0xc7, 0xcb, 0xce,
+}
+
+const DZX0_MOS6502_ZERO_PAGE_SIZE = 11
+
+// dzx0Mos6502At returns a copy of the 6502 decoder assembled for the given
+// address and zero page variables.
+func dzx0Mos6502At(address, zeroPage int) []byte {
+	code := append([]byte{}, dzx0Mos6502...)
+	for _, position := range dzx0Mos6502Relocations {
+		target := int(code[position]) | int(code[position+1])<<8 + address
+		code[position] = byte(target)
+		code[position+1] = byte(target >> 8)
+	}
+	for _, position := range dzx0Mos6502ZeroPage {
+		code[position] += byte(zeroPage)
+	}
+	return code
+}
@@ -0,0 +1,183 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	BLOAD_HEADER_SIZE = 7
+	BLOAD_MAGIC       = 0xfe
+
+	MSX_ROM_ADDRESS     = 0x4000
+	MSX_ROM_HEADER_SIZE = 16
+	MSX_ROM_16K         = 0x4000
+	MSX_ROM_32K         = 0x8000
+
+	// the BIOS stack and system variables live above this address
+	MSX_RAM_TOP = 0xf300
+)
+
+// BloadHeader is the 7-byte header of MSX-BASIC BLOAD binary files.
+type BloadHeader struct {
+	Start int
+	End   int
+	Exec  int
+}
+
+// ParseBloadHeader returns the BLOAD header at the start of data, or nil if
+// data does not begin with a consistent header.
+func ParseBloadHeader(data []byte) *BloadHeader {
+	if len(data) < BLOAD_HEADER_SIZE || data[0] != BLOAD_MAGIC {
+		return nil
+	}
+	header := &BloadHeader{
+		Start: int(data[1]) | int(data[2])<<8,
+		End:   int(data[3]) | int(data[4])<<8,
+		Exec:  int(data[5]) | int(data[6])<<8,
+	}
+	if header.End < header.Start {
+		return nil
+	}
+	return header
+}
+
+// StripBloadHeader splits data into its BLOAD header and the file contents
+// following it. The header is nil if data has no BLOAD header.
+func StripBloadHeader(data []byte) (*BloadHeader, []byte) {
+	header := ParseBloadHeader(data)
+	if header == nil {
+		return nil, data
+	}
+	body := data[BLOAD_HEADER_SIZE:]
+	if length := header.End - header.Start + 1; length < len(body) {
+		body = body[:length]
+	}
+	return header, body
+}
+
+// Bytes serializes the header.
+func (h *BloadHeader) Bytes() []byte {
+	return []byte{
+		BLOAD_MAGIC,
+		byte(h.Start), byte(h.Start >> 8),
+		byte(h.End), byte(h.End >> 8),
+		byte(h.Exec), byte(h.Exec >> 8),
+	}
+}
+
+// Wrap returns data prefixed with the header, updating the end address to
+// match the data.
+func (h *BloadHeader) Wrap(data []byte) []byte {
+	h.End = h.Start + len(data) - 1
+	return append(h.Bytes(), data...)
+}
+
+// Enables the slot of the ROM (page 1) on page 2 too, so the second half of
+// a 32K ROM becomes visible.
+//
+//	CD 38 01       call RSLREG
+//	0F             rrca
+//	0F             rrca
+//	E6 03          and  3         ; primary slot of page 1
+//	4F             ld   c, a
+//	06 00          ld   b, 0
+//	21 C1 FC       ld   hl, EXPTBL
+//	09             add  hl, bc
+//	7E             ld   a, (hl)
+//	E6 80          and  $80       ; expanded slot flag
+//	B1             or   c
+//	4F             ld   c, a
+//	23             inc  hl
+//	23             inc  hl
+//	23             inc  hl
+//	23             inc  hl        ; SLTTBL entry of the slot
+//	7E             ld   a, (hl)
+//	E6 0C          and  $0c       ; secondary slot of page 1
+//	B1             or   c
+//	26 80          ld   h, $80
+//	CD 24 00       call ENASLT
+//	FB             ei
+var msxEnablePage2 = []byte{
+	0xcd, 0x38, 0x01, 0x0f, 0x0f, 0xe6, 0x03, 0x4f, 0x06, 0x00, 0x21, 0xc1,
+	0xfc, 0x09, 0x7e, 0xe6, 0x80, 0xb1, 0x4f, 0x23, 0x23, 0x23, 0x23, 0x7e,
+	0xe6, 0x0c, 0xb1, 0x26, 0x80, 0xcd, 0x24, 0x00, 0xfb,
+}
+
+// BuildMsxRom creates a cartridge ROM image that unpacks the compressed
+// payload to RAM at the destination address on boot, then jumps to the
+// execution address. The payload must be compressed forward in the current
+// (v2) format. A romSize of 0 picks the smallest of 16K and 32K that fits.
+func BuildMsxRom(payload []byte, destination, exec, decompressedSize, romSize int) ([]byte, error) {
+	codeSize := MSX_ROM_HEADER_SIZE + 12 + len(dzx0StandardZ80)
+	if romSize == 0 {
+		romSize = MSX_ROM_16K
+		if codeSize+len(payload) > MSX_ROM_16K {
+			romSize = MSX_ROM_32K
+		}
+	}
+	if romSize != MSX_ROM_16K && romSize != MSX_ROM_32K {
+		return nil, fmt.Errorf("Unsupported ROM size %d", romSize)
+	}
+	if romSize == MSX_ROM_32K {
+		codeSize += len(msxEnablePage2)
+	}
+	if codeSize+len(payload) > romSize {
+		return nil, fmt.Errorf("Compressed data doesn't fit in %dK ROM", romSize/1024)
+	}
+
+	// RAM below the ROM pages is not available at boot time
+	ramBottom := MSX_ROM_ADDRESS + MSX_ROM_16K
+	if romSize == MSX_ROM_32K {
+		ramBottom = MSX_ROM_ADDRESS + MSX_ROM_32K
+	}
+	if destination < ramBottom || destination+decompressedSize > MSX_RAM_TOP {
+		return nil, fmt.Errorf("Destination area 0x%04X-0x%04X outside RAM available to %dK ROM (0x%04X-0x%04X)",
+			destination, destination+decompressedSize-1, romSize/1024, ramBottom, MSX_RAM_TOP-1)
+	}
+
+	init := MSX_ROM_ADDRESS + MSX_ROM_HEADER_SIZE
+	rom := []byte{'A', 'B', byte(init), byte(init >> 8)}
+	rom = append(rom, make([]byte, MSX_ROM_HEADER_SIZE-len(rom))...)
+	if romSize == MSX_ROM_32K {
+		rom = append(rom, msxEnablePage2...)
+	}
+
+	decoder := MSX_ROM_ADDRESS + len(rom) + 12
+	source := decoder + len(dzx0StandardZ80)
+	// ld hl, source; ld de, destination; call dzx0_standard; jp exec
+	rom = append(rom,
+		0x21, byte(source), byte(source>>8),
+		0x11, byte(destination), byte(destination>>8),
+		0xcd, byte(decoder), byte(decoder>>8),
+		0xc3, byte(exec), byte(exec>>8),
+	)
+	rom = append(rom, dzx0StandardZ80At(decoder)...)
+	rom = append(rom, payload...)
+	return append(rom, bytes.Repeat([]byte{0xff}, romSize-len(rom))...), nil
+}
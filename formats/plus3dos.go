@@ -0,0 +1,122 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+const (
+	PLUS3DOS_HEADER_SIZE = 128
+	PLUS3DOS_SIGNATURE   = "PLUS3DOS\x1a"
+
+	PLUS3DOS_TYPE_PROGRAM = 0
+	PLUS3DOS_TYPE_CODE    = 3
+)
+
+// Plus3dosHeader is the 128-byte header +3DOS places in front of files,
+// embedding the +3 BASIC header. For CODE files Param1 is the load address.
+type Plus3dosHeader struct {
+	FileType byte
+	Length   int
+	Param1   int
+	Param2   int
+}
+
+func plus3dosChecksum(data []byte) byte {
+	sum := byte(0)
+	for _, b := range data[:PLUS3DOS_HEADER_SIZE-1] {
+		sum += b
+	}
+	return sum
+}
+
+// ParsePlus3dosHeader returns the +3DOS header found at the start of data,
+// or nil if data does not begin with a header with a valid checksum.
+func ParsePlus3dosHeader(data []byte) *Plus3dosHeader {
+	if len(data) < PLUS3DOS_HEADER_SIZE || string(data[:len(PLUS3DOS_SIGNATURE)]) != PLUS3DOS_SIGNATURE {
+		return nil
+	}
+	if plus3dosChecksum(data) != data[PLUS3DOS_HEADER_SIZE-1] {
+		return nil
+	}
+	return &Plus3dosHeader{
+		FileType: data[15],
+		Length:   int(data[16]) | int(data[17])<<8,
+		Param1:   int(data[18]) | int(data[19])<<8,
+		Param2:   int(data[20]) | int(data[21])<<8,
+	}
+}
+
+// StripPlus3dosHeader splits data into its +3DOS header and the file
+// contents following it. The header is nil if data has no valid header.
+func StripPlus3dosHeader(data []byte) (*Plus3dosHeader, []byte) {
+	header := ParsePlus3dosHeader(data)
+	if header == nil {
+		return nil, data
+	}
+	body := data[PLUS3DOS_HEADER_SIZE:]
+	if header.Length < len(body) {
+		body = body[:header.Length]
+	}
+	return header, body
+}
+
+// NewPlus3dosCodeHeader creates a header for a CODE file loading at the
+// given address.
+func NewPlus3dosCodeHeader(loadAddress, length int) *Plus3dosHeader {
+	return &Plus3dosHeader{
+		FileType: PLUS3DOS_TYPE_CODE,
+		Length:   length,
+		Param1:   loadAddress,
+		Param2:   0x8000,
+	}
+}
+
+// Bytes serializes the header, computing its checksum.
+func (h *Plus3dosHeader) Bytes() []byte {
+	header := make([]byte, PLUS3DOS_HEADER_SIZE)
+	copy(header, PLUS3DOS_SIGNATURE)
+	header[9] = 1 // issue
+	header[10] = 0
+	fileLength := h.Length + PLUS3DOS_HEADER_SIZE
+	header[11] = byte(fileLength)
+	header[12] = byte(fileLength >> 8)
+	header[13] = byte(fileLength >> 16)
+	header[14] = byte(fileLength >> 24)
+	header[15] = h.FileType
+	header[16] = byte(h.Length)
+	header[17] = byte(h.Length >> 8)
+	header[18] = byte(h.Param1)
+	header[19] = byte(h.Param1 >> 8)
+	header[20] = byte(h.Param2)
+	header[21] = byte(h.Param2 >> 8)
+	header[PLUS3DOS_HEADER_SIZE-1] = plus3dosChecksum(header)
+	return header
+}
+
+// Wrap returns data prefixed with the header, updating the header length to
+// match the data.
+func (h *Plus3dosHeader) Wrap(data []byte) []byte {
+	h.Length = len(data)
+	return append(h.Bytes(), data...)
+}
@@ -0,0 +1,351 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	TRDOS_SECTOR_SIZE       = 256
+	TRDOS_SECTORS_PER_TRACK = 16
+	TRDOS_TRACKS            = 160
+	TRDOS_MAX_FILES         = 128
+	TRDOS_MAX_SECTORS       = 255
+	TRDOS_ENTRY_SIZE        = 16
+	TRDOS_INFO_SECTOR       = 8
+	TRDOS_DISK_TYPE_80_DS   = 0x16
+	TRDOS_ID                = 0x10
+	TRDOS_DELETED           = 0x01
+
+	TRDOS_TYPE_BASIC = 'B'
+	TRDOS_TYPE_CODE  = 'C'
+	TRDOS_TYPE_DATA  = 'D'
+
+	TRD_SIZE      = TRDOS_TRACKS * TRDOS_SECTORS_PER_TRACK * TRDOS_SECTOR_SIZE
+	SCL_SIGNATURE = "SINCLAIR"
+)
+
+// TrdosFile is a file stored on a TR-DOS disk. For CODE files Start is the
+// load address; Length is the file length in bytes.
+type TrdosFile struct {
+	Name   string
+	Type   byte
+	Start  int
+	Length int
+	Data   []byte
+}
+
+// NewTrdosCodeFile creates a CODE file, deriving the 8-character name from
+// the given path.
+func NewTrdosCodeFile(filename string, start int, data []byte) (*TrdosFile, error) {
+	if len(data) > TRDOS_MAX_SECTORS*TRDOS_SECTOR_SIZE || len(data) > 0xffff {
+		return nil, fmt.Errorf("File too large for TR-DOS (%d bytes)", len(data))
+	}
+	return &TrdosFile{
+		Name:   TrdosFilename(filename),
+		Type:   TRDOS_TYPE_CODE,
+		Start:  start,
+		Length: len(data),
+		Data:   data,
+	}, nil
+}
+
+// TrdosFilename converts a path into a TR-DOS filename, dropping its extension.
+func TrdosFilename(filename string) string {
+	base := filepath.Base(filename)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	if len(name) > 8 {
+		name = name[:8]
+	}
+	return name
+}
+
+func (f *TrdosFile) sectors() int {
+	return (len(f.Data) + TRDOS_SECTOR_SIZE - 1) / TRDOS_SECTOR_SIZE
+}
+
+// header returns the first 14 bytes of a directory entry, which are shared
+// by TRD and SCL images.
+func (f *TrdosFile) header() []byte {
+	header := []byte("        ")
+	copy(header, f.Name)
+	return append(header,
+		f.Type,
+		byte(f.Start), byte(f.Start>>8),
+		byte(f.Length), byte(f.Length>>8),
+		byte(f.sectors()),
+	)
+}
+
+func parseTrdosHeader(header []byte) *TrdosFile {
+	return &TrdosFile{
+		Name:   strings.TrimRight(string(header[0:8]), " "),
+		Type:   header[8],
+		Start:  int(header[9]) | int(header[10])<<8,
+		Length: int(header[11]) | int(header[12])<<8,
+	}
+}
+
+// TrdImage is an 80 track, double sided TR-DOS disk image.
+type TrdImage struct {
+	data []byte
+}
+
+// NewTrdImage creates a freshly formatted, empty disk image.
+func NewTrdImage(label string) *TrdImage {
+	t := &TrdImage{data: make([]byte, TRD_SIZE)}
+	info := t.data[TRDOS_INFO_SECTOR*TRDOS_SECTOR_SIZE:]
+	info[0xe1] = 0 // first free sector
+	info[0xe2] = 1 // first free track
+	info[0xe3] = TRDOS_DISK_TYPE_80_DS
+	free := (TRDOS_TRACKS - 1) * TRDOS_SECTORS_PER_TRACK
+	info[0xe5] = byte(free)
+	info[0xe6] = byte(free >> 8)
+	info[0xe7] = TRDOS_ID
+	copy(info[0xea:0xf3], "         ")
+	copy(info[0xf5:0xfd], padTrdosLabel(label))
+	return t
+}
+
+func padTrdosLabel(label string) []byte {
+	padded := []byte("        ")
+	copy(padded, label)
+	return padded
+}
+
+// ParseTrdImage loads a TR-DOS disk image. Images truncated after the last
+// used track are accepted and padded to full size.
+func ParseTrdImage(data []byte) (*TrdImage, error) {
+	if len(data) < TRDOS_SECTORS_PER_TRACK*TRDOS_SECTOR_SIZE || len(data) > TRD_SIZE {
+		return nil, fmt.Errorf("Invalid TRD image size %d", len(data))
+	}
+	t := &TrdImage{data: make([]byte, TRD_SIZE)}
+	copy(t.data, data)
+	if t.info()[0xe7] != TRDOS_ID {
+		return nil, fmt.Errorf("Not a TR-DOS disk image")
+	}
+	if _, err := t.firstFree(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TrdImage) info() []byte {
+	return t.data[TRDOS_INFO_SECTOR*TRDOS_SECTOR_SIZE : (TRDOS_INFO_SECTOR+1)*TRDOS_SECTOR_SIZE]
+}
+
+// firstFree returns the first free sector of the disk, counted from the
+// start of the image, checking that the free sectors recorded fit after it.
+func (t *TrdImage) firstFree() (int, error) {
+	info := t.info()
+	sector, track := int(info[0xe1]), int(info[0xe2])
+	free := int(info[0xe5]) | int(info[0xe6])<<8
+	start := track*TRDOS_SECTORS_PER_TRACK + sector
+	if sector >= TRDOS_SECTORS_PER_TRACK || start+free > TRD_SIZE/TRDOS_SECTOR_SIZE {
+		return 0, fmt.Errorf("Invalid free space in TRD image (sector %d, track %d, %d sectors)", sector, track, free)
+	}
+	return start, nil
+}
+
+func (t *TrdImage) entry(i int) []byte {
+	return t.data[i*TRDOS_ENTRY_SIZE : (i+1)*TRDOS_ENTRY_SIZE]
+}
+
+func (t *TrdImage) findFile(name string, fileType byte) int {
+	key := (&TrdosFile{Name: name}).header()[:8]
+	for i := 0; i < int(t.info()[0xe4]); i++ {
+		entry := t.entry(i)
+		if bytes.Equal(entry[0:8], key) && entry[8] == fileType {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasFile reports whether a file with the given name and type exists.
+func (t *TrdImage) HasFile(name string, fileType byte) bool {
+	return t.findFile(name, fileType) >= 0
+}
+
+// RemoveFile marks a file as deleted, like the TR-DOS ERASE command does.
+// Its sectors are only reclaimed if it was the last file on the disk.
+func (t *TrdImage) RemoveFile(name string, fileType byte) {
+	i := t.findFile(name, fileType)
+	if i < 0 {
+		return
+	}
+	info := t.info()
+	entry := t.entry(i)
+	if i == int(info[0xe4])-1 {
+		// reclaim the space of the last file
+		free := int(info[0xe5]) | int(info[0xe6])<<8 + int(entry[13])
+		info[0xe1] = entry[14]
+		info[0xe2] = entry[15]
+		info[0xe5] = byte(free)
+		info[0xe6] = byte(free >> 8)
+		info[0xe4]--
+		clear(entry)
+		return
+	}
+	entry[0] = TRDOS_DELETED
+	info[0xf4]++
+}
+
+// AddFile appends a file after the last used sector of the disk.
+func (t *TrdImage) AddFile(file *TrdosFile) error {
+	info := t.info()
+	count := int(info[0xe4])
+	free := int(info[0xe5]) | int(info[0xe6])<<8
+	if count >= TRDOS_MAX_FILES {
+		return fmt.Errorf("TRD image directory is full")
+	}
+	if file.sectors() > free {
+		return fmt.Errorf("Not enough space in TRD image (%d bytes free)", free*TRDOS_SECTOR_SIZE)
+	}
+
+	start, err := t.firstFree()
+	if err != nil {
+		return err
+	}
+	entry := t.entry(count)
+	copy(entry, file.header())
+	entry[14] = byte(start % TRDOS_SECTORS_PER_TRACK)
+	entry[15] = byte(start / TRDOS_SECTORS_PER_TRACK)
+	copy(t.data[start*TRDOS_SECTOR_SIZE:], file.Data)
+
+	next := start + file.sectors()
+	free -= file.sectors()
+	info[0xe1] = byte(next % TRDOS_SECTORS_PER_TRACK)
+	info[0xe2] = byte(next / TRDOS_SECTORS_PER_TRACK)
+	info[0xe4] = byte(count + 1)
+	info[0xe5] = byte(free)
+	info[0xe6] = byte(free >> 8)
+	return nil
+}
+
+// Bytes serializes the disk image.
+func (t *TrdImage) Bytes() []byte {
+	return t.data
+}
+
+// SclImage is an SCL archive, the compact form of a TR-DOS disk holding only
+// the files themselves.
+type SclImage struct {
+	Files []*TrdosFile
+}
+
+// NewSclImage creates an empty archive.
+func NewSclImage() *SclImage {
+	return &SclImage{}
+}
+
+// ParseSclImage loads an SCL archive, validating its checksum.
+func ParseSclImage(data []byte) (*SclImage, error) {
+	if len(data) < len(SCL_SIGNATURE)+5 || string(data[:len(SCL_SIGNATURE)]) != SCL_SIGNATURE {
+		return nil, fmt.Errorf("Not an SCL image")
+	}
+	body := data[:len(data)-4]
+	checksum := uint32(data[len(data)-4]) | uint32(data[len(data)-3])<<8 | uint32(data[len(data)-2])<<16 | uint32(data[len(data)-1])<<24
+	if sclChecksum(body) != checksum {
+		return nil, fmt.Errorf("Invalid SCL image checksum")
+	}
+
+	s := &SclImage{}
+	count := int(body[len(SCL_SIGNATURE)])
+	position := len(SCL_SIGNATURE) + 1 + count*(TRDOS_ENTRY_SIZE-2)
+	if position > len(body) {
+		return nil, fmt.Errorf("Truncated SCL image")
+	}
+	for i := 0; i < count; i++ {
+		header := body[len(SCL_SIGNATURE)+1+i*(TRDOS_ENTRY_SIZE-2):]
+		file := parseTrdosHeader(header)
+		size := int(header[13]) * TRDOS_SECTOR_SIZE
+		if position+size > len(body) {
+			return nil, fmt.Errorf("Truncated SCL image")
+		}
+		file.Data = body[position : position+size]
+		position += size
+		s.Files = append(s.Files, file)
+	}
+	return s, nil
+}
+
+func sclChecksum(data []byte) uint32 {
+	sum := uint32(0)
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return sum
+}
+
+func (s *SclImage) findFile(name string, fileType byte) int {
+	for i, file := range s.Files {
+		if file.Name == name && file.Type == fileType {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasFile reports whether a file with the given name and type exists.
+func (s *SclImage) HasFile(name string, fileType byte) bool {
+	return s.findFile(name, fileType) >= 0
+}
+
+// RemoveFile deletes a file from the archive.
+func (s *SclImage) RemoveFile(name string, fileType byte) {
+	if i := s.findFile(name, fileType); i >= 0 {
+		s.Files = append(s.Files[:i], s.Files[i+1:]...)
+	}
+}
+
+// AddFile appends a file to the archive.
+func (s *SclImage) AddFile(file *TrdosFile) error {
+	if len(s.Files) >= TRDOS_MAX_FILES {
+		return fmt.Errorf("SCL image directory is full")
+	}
+	s.Files = append(s.Files, file)
+	return nil
+}
+
+// Bytes serializes the archive, including its trailing checksum.
+func (s *SclImage) Bytes() []byte {
+	data := append([]byte(SCL_SIGNATURE), byte(len(s.Files)))
+	for _, file := range s.Files {
+		data = append(data, file.header()...)
+	}
+	for _, file := range s.Files {
+		sectorData := make([]byte, file.sectors()*TRDOS_SECTOR_SIZE)
+		copy(sectorData, file.Data)
+		data = append(data, sectorData...)
+	}
+	checksum := sclChecksum(data)
+	return append(data, byte(checksum), byte(checksum>>8), byte(checksum>>16), byte(checksum>>24))
+}
@@ -0,0 +1,172 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testTrdosFiles returns two CODE files, the second spanning several sectors.
+func testTrdosFiles(t *testing.T) []*TrdosFile {
+	files := []*TrdosFile{}
+	for i, size := range []int{100, 1000} {
+		file, err := NewTrdosCodeFile([]string{"one.bin", "two.bin"}[i], 0x8000, bytes.Repeat([]byte{byte(i + 1)}, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// testSclImage returns the body of an archive holding the test files, without
+// its checksum.
+func testSclImage(t *testing.T) []byte {
+	image := NewSclImage()
+	for _, file := range testTrdosFiles(t) {
+		if err := image.AddFile(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := image.Bytes()
+	return data[:len(data)-4]
+}
+
+// withSclChecksum appends a valid checksum to the body of an archive.
+func withSclChecksum(body []byte) []byte {
+	checksum := sclChecksum(body)
+	return append(append([]byte{}, body...), byte(checksum), byte(checksum>>8), byte(checksum>>16), byte(checksum>>24))
+}
+
+func TestParseSclImage(t *testing.T) {
+	image, err := ParseSclImage(withSclChecksum(testSclImage(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := testTrdosFiles(t)
+	if len(image.Files) != len(files) {
+		t.Fatalf("parsed %d files, %d stored", len(image.Files), len(files))
+	}
+	for i, file := range files {
+		parsed := image.Files[i]
+		if parsed.Name != file.Name || parsed.Length != file.Length || !bytes.Equal(parsed.Data[:parsed.Length], file.Data) {
+			t.Errorf("file %s parsed as %s, %d bytes", file.Name, parsed.Name, parsed.Length)
+		}
+	}
+}
+
+func TestParseTruncatedSclImage(t *testing.T) {
+	body := testSclImage(t)
+	for size := len(SCL_SIGNATURE) + 1; size < len(body); size++ {
+		if _, err := ParseSclImage(withSclChecksum(body[:size])); err == nil {
+			t.Errorf("image truncated to %d bytes accepted", size)
+		}
+	}
+}
+
+func TestParseMalformedSclImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(body []byte)
+	}{
+		{"too many files", func(body []byte) {
+			body[len(SCL_SIGNATURE)] = 255
+		}},
+		{"too many sectors", func(body []byte) {
+			body[len(SCL_SIGNATURE)+1+TRDOS_ENTRY_SIZE-2+13] = 255
+		}},
+	}
+	for _, test := range tests {
+		body := testSclImage(t)
+		test.change(body)
+		if _, err := ParseSclImage(withSclChecksum(body)); err == nil {
+			t.Errorf("%s: malformed image accepted", test.name)
+		}
+	}
+	body := testSclImage(t)
+	data := withSclChecksum(body)
+	data[len(data)-1]++
+	if _, err := ParseSclImage(data); err == nil {
+		t.Errorf("invalid checksum accepted")
+	}
+}
+
+func TestTrdImageAddFile(t *testing.T) {
+	image := NewTrdImage("test")
+	for _, file := range testTrdosFiles(t) {
+		if err := image.AddFile(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parsed, err := ParseTrdImage(image.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range testTrdosFiles(t) {
+		if !parsed.HasFile(file.Name, file.Type) {
+			t.Errorf("file %s missing", file.Name)
+		}
+	}
+}
+
+func TestParseMalformedTrdImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(info []byte)
+	}{
+		{"free sector beyond its track", func(info []byte) {
+			info[0xe1] = TRDOS_SECTORS_PER_TRACK
+		}},
+		{"free track beyond the disk", func(info []byte) {
+			info[0xe2] = 0xff
+		}},
+		{"more free sectors than left", func(info []byte) {
+			info[0xe5], info[0xe6] = 0xff, 0xff
+		}},
+	}
+	for _, test := range tests {
+		image := NewTrdImage("test")
+		test.change(image.info())
+		if _, err := ParseTrdImage(image.Bytes()); err == nil {
+			t.Errorf("%s: malformed image accepted", test.name)
+		}
+	}
+}
+
+func TestTrdImageAddFileAfterInvalidEntry(t *testing.T) {
+	image := NewTrdImage("test")
+	files := testTrdosFiles(t)
+	if err := image.AddFile(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	// removing the last file gives its sectors back, wherever its entry says
+	image.entry(0)[15] = 0xff
+	image.RemoveFile(files[0].Name, files[0].Type)
+	if err := image.AddFile(files[1]); err == nil {
+		t.Errorf("file added beyond the end of the disk")
+	}
+}
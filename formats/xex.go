@@ -0,0 +1,198 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+import (
+	"fmt"
+)
+
+const (
+	XEX_MAGIC  = 0xffff
+	XEX_RUNAD  = 0x02e0
+	XEX_INITAD = 0x02e2
+
+	// the OS ROM and I/O area start here, compressed data can't overflow into them
+	XEX_RAM_TOP = 0xc000
+
+	// INIT routine setting up the decoder for each compressed segment
+	XEX_STUB_SIZE = 19
+
+	XEX_DEFAULT_DECODER   = 0x0600
+	XEX_DEFAULT_ZERO_PAGE = 0xcb
+)
+
+// XexSegment is a load segment of an Atari 8-bit executable.
+type XexSegment struct {
+	Start int
+	Data  []byte
+}
+
+// End returns the address of the last byte of the segment.
+func (s *XexSegment) End() int {
+	return s.Start + len(s.Data) - 1
+}
+
+func (s *XexSegment) overlaps(start, end int) bool {
+	return s.Start <= end && start <= s.End()
+}
+
+// isVector reports whether the segment sets the RUN or INIT vectors.
+func (s *XexSegment) isVector() bool {
+	return s.overlaps(XEX_RUNAD, XEX_INITAD+1)
+}
+
+// ParseXex splits an Atari executable into its load segments.
+func ParseXex(data []byte) ([]*XexSegment, error) {
+	if len(data) < 2 || int(data[0])|int(data[1])<<8 != XEX_MAGIC {
+		return nil, fmt.Errorf("Not an Atari executable")
+	}
+	segments := []*XexSegment{}
+	for position := 0; position < len(data); {
+		if position+4 <= len(data) && int(data[position])|int(data[position+1])<<8 == XEX_MAGIC {
+			position += 2
+		}
+		if position+4 > len(data) {
+			return nil, fmt.Errorf("Truncated segment header at offset %d", position)
+		}
+		start := int(data[position]) | int(data[position+1])<<8
+		end := int(data[position+2]) | int(data[position+3])<<8
+		position += 4
+		if end < start || position+end-start+1 > len(data) {
+			return nil, fmt.Errorf("Invalid segment 0x%04X-0x%04X", start, end)
+		}
+		segments = append(segments, &XexSegment{start, data[position : position+end-start+1]})
+		position += end - start + 1
+	}
+	return segments, nil
+}
+
+// WriteXex serializes load segments into an Atari executable.
+func WriteXex(segments []*XexSegment) []byte {
+	data := []byte{0xff, 0xff}
+	for _, segment := range segments {
+		data = append(data, byte(segment.Start), byte(segment.Start>>8), byte(segment.End()), byte(segment.End()>>8))
+		data = append(data, segment.Data...)
+	}
+	return data
+}
+
+// MergeXexSegments joins segments loading at consecutive addresses. Segments
+// setting the RUN or INIT vectors are kept apart, so they still trigger at
+// the same point of the loading process.
+func MergeXexSegments(segments []*XexSegment) []*XexSegment {
+	merged := []*XexSegment{}
+	for _, segment := range segments {
+		if len(merged) > 0 {
+			last := merged[len(merged)-1]
+			if !last.isVector() && !segment.isVector() && last.End()+1 == segment.Start {
+				last.Data = append(append([]byte{}, last.Data...), segment.Data...)
+				continue
+			}
+		}
+		merged = append(merged, &XexSegment{segment.Start, segment.Data})
+	}
+	return merged
+}
+
+// XexCompressor compresses a segment forward in the current (v2) format,
+// returning the compressed data and its in-place decompression delta.
+type XexCompressor func(data []byte) ([]byte, int)
+
+// CompressXex replaces each segment by its compressed data and an INIT
+// routine that unpacks it in place, right after it's loaded. A decoder
+// segment is loaded first at the given address, using 11 bytes of zero page,
+// which must all fit below 0x100.
+// Segments setting the RUN and INIT vectors are kept as they are, as well as
+// segments that wouldn't get any smaller.
+func CompressXex(segments []*XexSegment, compress XexCompressor, decoderAddress, zeroPage int) ([]*XexSegment, error) {
+	if zeroPage < 0 || zeroPage+DZX0_MOS6502_ZERO_PAGE_SIZE > 0x100 {
+		return nil, fmt.Errorf("Decoder zero page address must be from 0x00 to 0x%02X", 0x100-DZX0_MOS6502_ZERO_PAGE_SIZE)
+	}
+	decoder := &XexSegment{decoderAddress, dzx0Mos6502At(decoderAddress, zeroPage)}
+	stubAddress := decoder.End() + 1
+	stubEnd := stubAddress + XEX_STUB_SIZE - 1
+	zeroPageEnd := zeroPage + DZX0_MOS6502_ZERO_PAGE_SIZE - 1
+	for _, segment := range segments {
+		if segment.overlaps(decoderAddress, stubEnd) {
+			return nil, fmt.Errorf("Segment 0x%04X-0x%04X overlaps decoder at 0x%04X-0x%04X",
+				segment.Start, segment.End(), decoderAddress, stubEnd)
+		}
+		if segment.overlaps(zeroPage, zeroPageEnd) {
+			return nil, fmt.Errorf("Segment 0x%04X-0x%04X overlaps decoder zero page at 0x%02X-0x%02X",
+				segment.Start, segment.End(), zeroPage, zeroPageEnd)
+		}
+	}
+
+	output := []*XexSegment{decoder}
+	loaded := []*XexSegment{decoder}
+	for _, segment := range segments {
+		if compressed := compressXexSegment(segment, compress, loaded, stubAddress, zeroPage); compressed != nil {
+			output = append(output, compressed...)
+		} else {
+			output = append(output, segment)
+		}
+		loaded = append(loaded, segment)
+	}
+	return output, nil
+}
+
+func compressXexSegment(segment *XexSegment, compress XexCompressor, loaded []*XexSegment, stubAddress, zeroPage int) []*XexSegment {
+	if segment.isVector() {
+		return nil
+	}
+	data, delta := compress(segment.Data)
+
+	// data, stub and INIT vector segments, each with their 4-byte headers
+	if 4+len(data)+4+XEX_STUB_SIZE+4+2 >= 4+len(segment.Data) {
+		return nil
+	}
+
+	// place compressed data at the end, so it can be decompressed in place
+	source := &XexSegment{segment.End() + 1 + delta - len(data), data}
+	if source.End() >= XEX_RAM_TOP && segment.End() < XEX_RAM_TOP {
+		return nil
+	}
+	if source.End() > segment.End() {
+		for _, other := range loaded {
+			if other.overlaps(segment.End()+1, source.End()) {
+				return nil
+			}
+		}
+	}
+
+	// lda #<source; sta src; lda #>source; sta src+1;
+	// lda #<destination; sta dst; lda #>destination; sta dst+1; jmp decode
+	decoderAddress := stubAddress - len(dzx0Mos6502)
+	stub := &XexSegment{stubAddress, []byte{
+		0xa9, byte(source.Start), 0x85, byte(zeroPage + 1),
+		0xa9, byte(source.Start >> 8), 0x85, byte(zeroPage + 2),
+		0xa9, byte(segment.Start), 0x85, byte(zeroPage + 3),
+		0xa9, byte(segment.Start >> 8), 0x85, byte(zeroPage + 4),
+		0x4c, byte(decoderAddress), byte(decoderAddress >> 8),
+	}}
+	init := &XexSegment{XEX_INITAD, []byte{byte(stubAddress), byte(stubAddress >> 8)}}
+	return []*XexSegment{source, stub, init}
+}
@@ -0,0 +1,97 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package formats
+
+// The "standard" Z80 decoder by Einar Saukas & Urusergi, assembled at
+// address 0. Call with HL pointing to the compressed data and DE to the
+// destination address.
+//
+//	0000  01 FF FF           ld   bc, $ffff     ; preserve default offset 1
+//	0003  C5                 push bc
+//	0004  03                 inc  bc
+//	0005  3E 80              ld   a, $80
+//	0007  CD 35 00   lit:    call elias         ; obtain length
+//	000A  ED B0              ldir               ; copy literals
+//	000C  87                 add  a, a          ; copy from last offset or new offset?
+//	000D  38 0D              jr   c, new
+//	000F  CD 35 00           call elias         ; obtain length
+//	0012  E3         copy:   ex   (sp), hl      ; preserve source, restore offset
+//	0013  E5                 push hl            ; preserve offset
+//	0014  19                 add  hl, de        ; calculate destination - offset
+//	0015  ED B0              ldir               ; copy from offset
+//	0017  E1                 pop  hl            ; restore offset
+//	0018  E3                 ex   (sp), hl      ; preserve offset, restore source
+//	0019  87                 add  a, a          ; copy from literals or new offset?
+//	001A  30 EB              jr   nc, lit
+//	001C  C1         new:    pop  bc            ; discard last offset
+//	001D  0E FE              ld   c, $fe        ; prepare negative offset
+//	001F  CD 36 00           call loop          ; obtain offset MSB
+//	0022  0C                 inc  c
+//	0023  C8                 ret  z             ; check end marker
+//	0024  41                 ld   b, c
+//	0025  4E                 ld   c, (hl)       ; obtain offset LSB
+//	0026  23                 inc  hl
+//	0027  CB 18              rr   b             ; last offset bit becomes first length bit
+//	0029  CB 19              rr   c
+//	002B  C5                 push bc            ; preserve new offset
+//	002C  01 01 00           ld   bc, 1         ; obtain length
+//	002F  D4 3D 00           call nc, back
+//	0032  03                 inc  bc
+//	0033  18 DD              jr   copy
+//	0035  0C         elias:  inc  c             ; interlaced Elias gamma coding
+//	0036  87         loop:   add  a, a
+//	0037  20 03              jr   nz, skip
+//	0039  7E                 ld   a, (hl)       ; load another group of 8 bits
+//	003A  23                 inc  hl
+//	003B  17                 rla
+//	003C  D8         skip:   ret  c
+//	003D  87         back:   add  a, a
+//	003E  CB 11              rl   c
+//	0040  CB 10              rl   b
+//	0042  18 F2              jr   loop
+var dzx0StandardZ80 = []byte{
+	0x01, 0xff, 0xff, 0xc5, 0x03, 0x3e, 0x80, 0xcd, 0x35, 0x00, 0xed, 0xb0,
+	0x87, 0x38, 0x0d, 0xcd, 0x35, 0x00, 0xe3, 0xe5, 0x19, 0xed, 0xb0, 0xe1,
+	0xe3, 0x87, 0x30, 0xeb, 0xc1, 0x0e, 0xfe, 0xcd, 0x36, 0x00, 0x0c, 0xc8,
+	0x41, 0x4e, 0x23, 0xcb, 0x18, 0xcb, 0x19, 0xc5, 0x01, 0x01, 0x00, 0xd4,
+	0x3d, 0x00, 0x03, 0x18, 0xdd, 0x0c, 0x87, 0x20, 0x03, 0x7e, 0x23, 0x17,
+	0xd8, 0x87, 0xcb, 0x11, 0xcb, 0x10, 0x18, 0xf2,
+}
+
+// offsets of the absolute CALL targets within dzx0StandardZ80
+var dzx0StandardZ80Relocations = []int{0x08, 0x10, 0x20, 0x30}
+
+// dzx0StandardZ80At returns a copy of the Z80 decoder assembled for the given address.
+func dzx0StandardZ80At(address int) []byte {
+	code := append([]byte{}, dzx0StandardZ80...)
+	for _, position := range dzx0StandardZ80Relocations {
+		target := int(code[position]) | int(code[position+1])<<8 + address
+		code[position] = byte(target)
+		code[position+1] = byte(target >> 8)
+	}
+	return code
+}
@@ -0,0 +1,337 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// HeatmapBucket is a bar of a histogram, counting values from Low to High.
+type HeatmapBucket struct {
+	Low, High int
+	Count     int
+	Percent   float64
+}
+
+func (b HeatmapBucket) Label() string {
+	if b.Low == b.High {
+		return fmt.Sprint(b.Low)
+	}
+	return fmt.Sprintf("%d-%d", b.Low, b.High)
+}
+
+// HeatmapReport holds the contents of an HTML compression report.
+type HeatmapReport struct {
+	Name             string
+	Mode             string
+	InputSize        int
+	Skip             int
+	CompressedSize   int
+	Delta            int
+	BitsPerByte      float64
+	Ratio            float64
+	LiteralRuns      int
+	LiteralBytes     int
+	RepeatMatches    int
+	NewOffsetMatches int
+	Offsets          []HeatmapBucket
+	Lengths          []HeatmapBucket
+	Data             template.JS
+}
+
+// heatmapHistogram counts values in power of two ranges: 1, 2-3, 4-7...
+func heatmapHistogram(values []int) []HeatmapBucket {
+	buckets := []HeatmapBucket{}
+	for _, value := range values {
+		index := 0
+		for 2<<index <= value {
+			index++
+		}
+		for len(buckets) <= index {
+			low := 1 << len(buckets)
+			buckets = append(buckets, HeatmapBucket{Low: low, High: low*2 - 1})
+		}
+		buckets[index].Count++
+	}
+	largest := 1
+	for _, bucket := range buckets {
+		largest = max(largest, bucket.Count)
+	}
+	for i := range buckets {
+		buckets[i].Percent = float64(buckets[i].Count) * 100 / float64(largest)
+	}
+	return buckets
+}
+
+// newHeatmapReport analyzes the optimal chain of blocks for an input, as
+// given to the compressor (reversed in backwards mode).
+func newHeatmapReport(name string, input []byte, optimal *zx0.Block, o *Options) *HeatmapReport {
+	report := &HeatmapReport{Name: name, InputSize: len(input), Skip: o.Skip}
+	switch {
+	case o.BackwardsMode:
+		report.Mode = "backwards"
+	case o.ClassicMode:
+		report.Mode = "classic (v1), forward"
+	default:
+		report.Mode = "current (v2), forward"
+	}
+	if level := o.level(); level == zx0.LEVEL_QUICK {
+		report.Mode += ", quick"
+	} else if level < zx0.LEVEL_OPTIMAL {
+		report.Mode += fmt.Sprintf(", level %d", level)
+	}
+
+	// tokens as [start, length, type, offset, bits], in file positions
+	tokens := [][5]int{}
+	offsets, lengths := []int{}, []int{}
+	lastOffset := zx0.INITIAL_OFFSET
+	sequence := optimal.Sequence()
+	for i := 1; i < len(sequence); i++ {
+		block, previous := sequence[i], sequence[i-1]
+		length, bits := block.Index-previous.Index, block.Bits-previous.Bits
+		start := previous.Index + 1
+		if o.BackwardsMode {
+			start = len(input) - start - length
+		}
+		switch {
+		case block.Offset == 0:
+			report.LiteralRuns++
+			report.LiteralBytes += length
+			tokens = append(tokens, [5]int{start, length, int(zx0.TOKEN_LITERALS), 0, bits})
+		case block.Offset == lastOffset:
+			report.RepeatMatches++
+			lengths = append(lengths, length)
+			tokens = append(tokens, [5]int{start, length, int(zx0.TOKEN_LAST_OFFSET), block.Offset, bits})
+		default:
+			report.NewOffsetMatches++
+			lengths = append(lengths, length)
+			offsets = append(offsets, block.Offset)
+			tokens = append(tokens, [5]int{start, length, int(zx0.TOKEN_NEW_OFFSET), block.Offset, bits})
+			lastOffset = block.Offset
+		}
+	}
+	report.Offsets = heatmapHistogram(offsets)
+	report.Lengths = heatmapHistogram(lengths)
+
+	data := input
+	if o.BackwardsMode {
+		data = append([]byte{}, input...)
+		reverse(data)
+	}
+	skipStart, skipEnd := 0, o.Skip
+	if o.BackwardsMode {
+		skipStart, skipEnd = len(input)-o.Skip, len(input)
+	}
+	encoded, _ := json.Marshal(map[string]any{
+		"bytes":  base64.StdEncoding.EncodeToString(data),
+		"tokens": tokens,
+		"skip":   []int{skipStart, skipEnd},
+	})
+	report.Data = template.JS(encoded)
+	return report
+}
+
+// heatmapCommand compresses a file and writes an HTML report coloring every
+// byte by its cost in bits.
+func heatmapCommand(arguments []string) {
+	o := &Options{}
+	flags := newFlagSet("heatmap")
+	o.threadFlags(flags)
+	o.levelFlags(flags)
+	flags.IntVar(&o.Skip, "s", 0, "Skip N bytes")
+	o.memoryFlags(flags)
+	o.formatFlags(flags)
+	flags.BoolVar(&o.ForcedMode, "f", false, "Force overwrite of output file")
+	flags.Parse(arguments)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := checkOptions(o, o.Threads); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	inputName := flags.Arg(0)
+	outputName := inputName + ".html"
+	if flags.NArg() == 2 {
+		outputName = flags.Arg(1)
+	}
+
+	input, err := readFile(inputName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", inputName)
+		os.Exit(1)
+	}
+	if len(input) == 0 || o.Skip >= len(input) {
+		fmt.Fprintf(os.Stderr, "Error: Nothing to compress in input file %s\n", inputName)
+		os.Exit(1)
+	}
+	if !o.ForcedMode && outputName != "-" && fileExists(outputName) {
+		fmt.Fprintf(os.Stderr, "Error: Already existing output file %s\n", outputName)
+		os.Exit(1)
+	}
+
+	if o.BackwardsMode {
+		reverse(input)
+	}
+	optimizer := zx0.NewOptimizer()
+	optimizer.SetLevel(o.level())
+	optimizer.SetMaxMemory(o.MaxMemory)
+	optimal := optimizer.Optimize(input, o.Skip, MAX_OFFSET_ZX0, o.Threads, true)
+	report := newHeatmapReport(filepath.Base(inputName), input, optimal, o)
+
+	// the compressor reorders the chain, so it runs after the analysis
+	delta := []int{0}
+	output := zx0.NewCompressor().Compress(optimal, input, o.Skip, o.BackwardsMode, !o.ClassicMode && !o.BackwardsMode, delta)
+	report.CompressedSize, report.Delta = len(output), delta[0]
+	report.BitsPerByte = float64(len(output)*8) / float64(len(input)-o.Skip)
+	report.Ratio = float64(len(output)) * 100 / float64(len(input)-o.Skip)
+
+	var html strings.Builder
+	if err := heatmapTemplate.Execute(&html, report); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeFile(outputName, []byte(html.String())); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", outputName)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Report of %d bytes compressed to %d bytes written to %s\n", len(input)-o.Skip, len(output), outputName)
+}
+
+var heatmapTemplate = template.Must(template.New("heatmap").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ZX0 report: {{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; background: #fafafa; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table.summary td { padding: 2px 12px 2px 0; }
+#map { font-family: monospace; font-size: 11px; line-height: 14px; }
+#map div span { display: inline-block; width: 18px; text-align: center; cursor: default; }
+#map div b { display: inline-block; width: 50px; font-weight: normal; color: #888; }
+#map span.current { outline: 2px solid #000; }
+#info { position: sticky; top: 0; background: #fff; border: 1px solid #ccc; padding: 6px 10px; min-height: 2.6em; font-family: monospace; }
+#legend span { display: inline-block; width: 40px; text-align: center; font-size: 11px; }
+table.histogram td { padding: 1px 6px; font-size: 12px; }
+table.histogram td.bar div { background: #4a7; height: 12px; }
+</style>
+</head>
+<body>
+<h1>ZX0 compression report: {{.Name}}</h1>
+<table class="summary">
+<tr><td>Mode</td><td>{{.Mode}}</td></tr>
+<tr><td>Input</td><td>{{.InputSize}} bytes{{if .Skip}} (skipping {{.Skip}}){{end}}</td></tr>
+<tr><td>Compressed</td><td>{{.CompressedSize}} bytes ({{printf "%.2f" .Ratio}}%, {{printf "%.3f" .BitsPerByte}} bits per byte, delta {{.Delta}})</td></tr>
+<tr><td>Literal runs</td><td>{{.LiteralRuns}} ({{.LiteralBytes}} bytes)</td></tr>
+<tr><td>Repeat matches</td><td>{{.RepeatMatches}}</td></tr>
+<tr><td>New offset matches</td><td>{{.NewOffsetMatches}}</td></tr>
+</table>
+
+<h2>Cost per byte</h2>
+<div id="legend"></div>
+<p id="info">Hover over a byte to see the token covering it.</p>
+<div id="map"></div>
+
+<h2>Offsets of new offset matches</h2>
+<table class="histogram">
+{{range .Offsets}}<tr><td>{{.Label}}</td><td>{{.Count}}</td><td class="bar" style="width: 400px"><div style="width: {{printf "%.1f" .Percent}}%"></div></td></tr>
+{{end}}</table>
+
+<h2>Lengths of matches</h2>
+<table class="histogram">
+{{range .Lengths}}<tr><td>{{.Label}}</td><td>{{.Count}}</td><td class="bar" style="width: 400px"><div style="width: {{printf "%.1f" .Percent}}%"></div></td></tr>
+{{end}}</table>
+
+<script>
+const data = {{.Data}};
+const bytes = Uint8Array.from(atob(data.bytes), c => c.charCodeAt(0));
+const names = ["literals", "last offset", "new offset"];
+const owner = new Int32Array(bytes.length).fill(-1);
+data.tokens.forEach((t, i) => { for (let p = t[0]; p < t[0] + t[1]; p++) owner[p] = i; });
+
+function color(cost) {
+  return "hsl(" + Math.round(120 - Math.min(cost, 10) * 12) + ", 75%, 60%)";
+}
+function hex(value, digits) {
+  return value.toString(16).toUpperCase().padStart(digits, "0");
+}
+
+const legend = document.getElementById("legend");
+for (let cost = 0; cost <= 10; cost++) {
+  const span = document.createElement("span");
+  span.style.background = color(cost);
+  span.textContent = cost + (cost == 10 ? "+" : "") + " b";
+  legend.appendChild(span);
+}
+
+const map = document.getElementById("map");
+const info = document.getElementById("info");
+let current = null;
+for (let row = 0; row < bytes.length; row += 32) {
+  const line = document.createElement("div");
+  line.innerHTML = "<b>" + hex(row, 6) + "</b>";
+  for (let p = row; p < Math.min(row + 32, bytes.length); p++) {
+    const span = document.createElement("span");
+    span.textContent = hex(bytes[p], 2);
+    span.dataset.p = p;
+    const t = data.tokens[owner[p]];
+    span.style.background = t ? color(t[4] / t[1]) : "#ccc";
+    line.appendChild(span);
+  }
+  map.appendChild(line);
+}
+map.addEventListener("mouseover", event => {
+  if (event.target.dataset.p === undefined) return;
+  if (current) current.classList.remove("current");
+  current = event.target;
+  current.classList.add("current");
+  const p = Number(current.dataset.p);
+  const t = data.tokens[owner[p]];
+  let text = "Byte 0x" + hex(p, 6) + " = 0x" + hex(bytes[p], 2) + "<br>";
+  if (!t) {
+    text += "Skipped, not compressed";
+  } else {
+    text += names[t[2]] + " at 0x" + hex(t[0], 6) + ", length " + t[1];
+    if (t[2] > 0) text += ", offset " + t[3];
+    text += ", " + t[4] + " bits (" + (t[4] / t[1]).toFixed(2) + " bits per byte)";
+  }
+  info.innerHTML = text;
+});
+</script>
+</body>
+</html>
+`))
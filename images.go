@@ -0,0 +1,200 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/mojzesh/zx0-go/formats"
+)
+
+// addToDsk stores a file on a DSK image, creating the image if it does not
+// exist yet. Files on +3 disks get a +3DOS header for a CODE file loading at
+// the given address, unless they already have one.
+func addToDsk(imageName, formatName string, extended, forcedMode bool, filename string, data []byte, loadAddress int) error {
+	var image *formats.DskImage
+	if fileExists(imageName) {
+		imageData, err := os.ReadFile(imageName)
+		if err != nil {
+			return fmt.Errorf("Cannot read disk image %s", imageName)
+		}
+		image, err = formats.ParseDskImage(imageData)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, imageName)
+		}
+	} else {
+		format, err := formats.FindDskFormat(formatName)
+		if err != nil {
+			return err
+		}
+		image = formats.NewDskImage(format, extended)
+	}
+
+	if image.Format.DiscSpec && formats.ParsePlus3dosHeader(data) == nil {
+		data = formats.NewPlus3dosCodeHeader(max(loadAddress, 0), len(data)).Wrap(data)
+	}
+
+	exists, err := image.HasFile(filename)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if !forcedMode {
+			return fmt.Errorf("Already existing file %s in disk image %s", filename, imageName)
+		}
+		if err := image.RemoveFile(filename); err != nil {
+			return err
+		}
+	}
+	if err := image.AddFile(filename, data); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(imageName, image.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Cannot write disk image %s", imageName)
+	}
+	return nil
+}
+
+// addToTrd stores a CODE file on a TRD image, creating the image if it does
+// not exist yet.
+func addToTrd(imageName string, forcedMode bool, filename string, data []byte, loadAddress int) error {
+	file, err := formats.NewTrdosCodeFile(filename, max(loadAddress, 0), data)
+	if err != nil {
+		return err
+	}
+
+	var image *formats.TrdImage
+	if fileExists(imageName) {
+		imageData, err := os.ReadFile(imageName)
+		if err != nil {
+			return fmt.Errorf("Cannot read disk image %s", imageName)
+		}
+		image, err = formats.ParseTrdImage(imageData)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, imageName)
+		}
+	} else {
+		image = formats.NewTrdImage(file.Name)
+	}
+
+	if image.HasFile(file.Name, file.Type) {
+		if !forcedMode {
+			return fmt.Errorf("Already existing file %s in disk image %s", file.Name, imageName)
+		}
+		image.RemoveFile(file.Name, file.Type)
+	}
+	if err := image.AddFile(file); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(imageName, image.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Cannot write disk image %s", imageName)
+	}
+	return nil
+}
+
+// addToScl stores a CODE file on an SCL image, creating the image if it does
+// not exist yet.
+func addToScl(imageName string, forcedMode bool, filename string, data []byte, loadAddress int) error {
+	file, err := formats.NewTrdosCodeFile(filename, max(loadAddress, 0), data)
+	if err != nil {
+		return err
+	}
+
+	image := formats.NewSclImage()
+	if fileExists(imageName) {
+		imageData, err := os.ReadFile(imageName)
+		if err != nil {
+			return fmt.Errorf("Cannot read disk image %s", imageName)
+		}
+		image, err = formats.ParseSclImage(imageData)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, imageName)
+		}
+	}
+
+	if image.HasFile(file.Name, file.Type) {
+		if !forcedMode {
+			return fmt.Errorf("Already existing file %s in disk image %s", file.Name, imageName)
+		}
+		image.RemoveFile(file.Name, file.Type)
+	}
+	if err := image.AddFile(file); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(imageName, image.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Cannot write disk image %s", imageName)
+	}
+	return nil
+}
+
+// buildMsxRom wraps compressed data in an MSX cartridge ROM of the requested
+// size ("16", "32" or "auto").
+func buildMsxRom(output []byte, destination, exec, decompressedSize int, romSize string) ([]byte, error) {
+	if destination < 0 {
+		return nil, fmt.Errorf("ROM requires a destination address (-load or -bload)")
+	}
+	size := 0
+	if romSize != "auto" {
+		kilobytes, err := strconv.Atoi(romSize)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ROM size %s", romSize)
+		}
+		size = kilobytes * 1024
+	}
+	return formats.BuildMsxRom(output, destination, exec, decompressedSize, size)
+}
+
+// compressXex compresses each load segment of an Atari executable, adding a
+// 6502 decoder that unpacks every segment as soon as DOS loads it. The peak
+// memory is the largest used by any segment.
+func compressXex(input []byte, decoderAddress, zeroPage int, merge bool, level, threads int, maxMemory int64, peakMemory *int64) ([]byte, error) {
+	segments, err := formats.ParseXex(input)
+	if err != nil {
+		return nil, err
+	}
+	if merge {
+		segments = formats.MergeXexSegments(segments)
+	}
+	compress := func(data []byte) ([]byte, int) {
+		delta := []int{0}
+		memory := int64(0)
+		output := zx0Fn(data, 0, false, false, level, threads, maxMemory, false, delta, &memory)
+		if peakMemory != nil {
+			*peakMemory = max(*peakMemory, memory)
+		}
+		return output, delta[0]
+	}
+	segments, err = formats.CompressXex(segments, compress, decoderAddress, zeroPage)
+	if err != nil {
+		return nil, err
+	}
+	return formats.WriteXex(segments), nil
+}
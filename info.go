@@ -0,0 +1,210 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// StreamFormat is a combination of file format and direction a compressed
+// stream can be decoded with.
+type StreamFormat struct {
+	Name      string
+	Backwards bool
+	Classic   bool
+}
+
+// backwards streams are identical in both file formats
+var streamFormats = []StreamFormat{
+	{"current (v2), forward", false, false},
+	{"classic (v1), forward", false, true},
+	{"backwards", true, false},
+}
+
+// StreamInfo is the result of inspecting a compressed stream.
+type StreamInfo struct {
+	Input    string   `json:"input"`
+	Formats  []string `json:"formats"`
+	Trailing int      `json:"trailing_bytes"`
+	zx0.Stats
+}
+
+// ContainerInfo is the result of inspecting a block container, listing the
+// position of every block.
+type ContainerInfo struct {
+	Input            string           `json:"input"`
+	Format           string           `json:"format"`
+	CompressedSize   int              `json:"compressed_size"`
+	DecompressedSize int              `json:"decompressed_size"`
+	BlockSize        int              `json:"block_size"`
+	Dictionary       int              `json:"dictionary"`
+	Index            []zx0.IndexEntry `json:"index"`
+}
+
+func newContainerInfo(filename string, input []byte, container *zx0.Container) *ContainerInfo {
+	format := streamFormats[0].Name
+	if container.Classic {
+		format = streamFormats[1].Name
+	}
+	return &ContainerInfo{
+		Input:            filename,
+		Format:           "block container, " + format,
+		CompressedSize:   len(input),
+		DecompressedSize: container.Size,
+		BlockSize:        container.BlockSize,
+		Dictionary:       container.Dictionary,
+		Index:            container.Index(),
+	}
+}
+
+func (c *ContainerInfo) print() {
+	fmt.Printf("%s:\n", c.Input)
+	fmt.Printf("  Format:             %s\n", c.Format)
+	fmt.Printf("  Compressed size:    %d bytes\n", c.CompressedSize)
+	fmt.Printf("  Decompressed size:  %d bytes (%.2f%%)\n", c.DecompressedSize,
+		float64(c.CompressedSize)*100/float64(max(c.DecompressedSize, 1)))
+	fmt.Printf("  Blocks:             %d of %d bytes\n", len(c.Index), c.BlockSize)
+	fmt.Printf("  Dictionary:         %d bytes\n", c.Dictionary)
+	fmt.Printf("  %8s %10s %10s %10s %10s\n", "Block", "Start", "Size", "Offset", "Compressed")
+	for i, entry := range c.Index {
+		fmt.Printf("  %8d %10d %10d %10d %10d\n", i, entry.Start, entry.Size, entry.Offset, entry.CompressedSize)
+	}
+}
+
+// inspect walks a compressed stream with each of the given formats, keeping
+// those that decode it without errors. Formats consuming the whole stream
+// are preferred to those leaving trailing bytes.
+func inspect(input []byte, formats []StreamFormat) (*StreamInfo, error) {
+	var info *StreamInfo
+	var lastErr error
+	for _, format := range formats {
+		data := append([]byte{}, input...)
+		if format.Backwards {
+			reverse(data)
+		}
+		decompressor := zx0.NewDecompressor()
+		if _, err := decompressor.Decompress(data, format.Backwards, !format.Classic && !format.Backwards); err != nil {
+			lastErr = err
+			continue
+		}
+		stats := decompressor.Stats()
+		trailing := len(input) - stats.CompressedSize
+		if info == nil || trailing < info.Trailing {
+			info = &StreamInfo{Formats: []string{format.Name}, Trailing: trailing, Stats: stats}
+		} else if trailing == info.Trailing {
+			info.Formats = append(info.Formats, format.Name)
+		}
+	}
+	if info == nil {
+		return nil, lastErr
+	}
+	return info, nil
+}
+
+// infoCommand reports the contents of compressed files, detecting their
+// file format and direction unless given.
+func infoCommand(arguments []string) {
+	o := &Options{}
+	flags := newFlagSet("info")
+	o.formatFlags(flags)
+	flags.BoolVar(&o.JsonMode, "json", false, "Report results as JSON records, one line per file")
+	flags.Parse(arguments)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	formats := streamFormats
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "c" || f.Name == "b" {
+			formats = []StreamFormat{{"classic (v1), forward", o.BackwardsMode, o.ClassicMode}}
+			if o.BackwardsMode {
+				formats[0].Name = "backwards"
+			} else if !o.ClassicMode {
+				formats[0].Name = "current (v2), forward"
+			}
+		}
+	})
+
+	failed := false
+	for _, filename := range flags.Args() {
+		input, err := readFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", filename)
+			failed = true
+			continue
+		}
+		if container, err := zx0.ParseContainer(input); err == nil {
+			info := newContainerInfo(filename, input, container)
+			if o.JsonMode {
+				record, _ := json.Marshal(info)
+				fmt.Println(string(record))
+			} else {
+				info.print()
+			}
+			continue
+		}
+		info, err := inspect(input, formats)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid input file %s (%v)\n", filename, err)
+			failed = true
+			continue
+		}
+		info.Input = filename
+
+		if o.JsonMode {
+			record, _ := json.Marshal(info)
+			fmt.Println(string(record))
+			continue
+		}
+		fmt.Printf("%s:\n", filename)
+		if len(info.Formats) > 1 {
+			fmt.Printf("  Format:             ambiguous, %s\n", strings.Join(info.Formats, " or "))
+		} else {
+			fmt.Printf("  Format:             %s\n", info.Formats[0])
+		}
+		fmt.Printf("  Compressed size:    %d bytes\n", info.CompressedSize)
+		if info.Trailing > 0 {
+			fmt.Printf("  Trailing data:      %d bytes\n", info.Trailing)
+		}
+		fmt.Printf("  Decompressed size:  %d bytes (%.2f%%)\n", info.DecompressedSize,
+			float64(info.CompressedSize)*100/float64(max(info.DecompressedSize, 1)))
+		fmt.Printf("  Literal runs:       %d (%d bytes)\n", info.LiteralRuns, info.LiteralBytes)
+		fmt.Printf("  Repeat matches:     %d\n", info.RepeatMatches)
+		fmt.Printf("  New offset matches: %d\n", info.NewOffsetMatches)
+		fmt.Printf("  Matched bytes:      %d\n", info.MatchedBytes)
+		fmt.Printf("  Largest offset:     %d\n", info.LargestOffset)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
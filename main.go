@@ -27,17 +27,22 @@
 package main
 
 import (
-	"flag"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/mojzesh/zx0-go/formats"
 	"github.com/mojzesh/zx0-go/zx0"
 )
 
 const (
+	VERSION         = "2.2"
 	MAX_OFFSET_ZX0  = 32640
-	MAX_OFFSET_ZX7  = 2176
 	DEFAULT_THREADS = 4
 )
 
@@ -51,61 +56,165 @@ func reverse(array []byte) {
 	}
 }
 
-func zx0Fn(input []byte, skip int, backwardsMode, classicMode, quickMode bool, threads int, verbose bool, delta []int) []byte {
-	var mode int
-	if quickMode {
-		mode = MAX_OFFSET_ZX7
-	} else {
-		mode = MAX_OFFSET_ZX0
+func zx0Fn(input []byte, skip int, backwardsMode, classicMode bool, level, threads int, maxMemory int64, verbose bool, delta []int, peakMemory *int64) []byte {
+	optimizer := zx0.NewOptimizer()
+	optimizer.SetLevel(level)
+	optimizer.SetMaxMemory(maxMemory)
+	return compressFn(optimizer, input, skip, backwardsMode, classicMode, threads, verbose, delta, peakMemory)
+}
+
+// compressFn compresses an input with an optimizer already set up.
+func compressFn(optimizer *zx0.Optimizer, input []byte, skip int, backwardsMode, classicMode bool, threads int, verbose bool, delta []int, peakMemory *int64) []byte {
+	optimal := optimizer.Optimize(input, skip, MAX_OFFSET_ZX0, threads, verbose)
+	if peakMemory != nil {
+		*peakMemory = optimizer.PeakMemory()
+	}
+	return zx0.NewCompressor().Compress(optimal, input, skip, backwardsMode, !classicMode && !backwardsMode, delta)
+}
+
+// checkMaxMemory rejects a memory budget too small for the optimizer, shared
+// by a number of compressions running at the same time with the threads
+// given.
+func checkMaxMemory(maxMemory int64, threads, compressions int) error {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
 	}
-	return zx0.NewCompressor().Compress(
-		zx0.NewOptimizer().Optimize(input, skip, mode, threads, verbose),
-		input, skip, backwardsMode, !classicMode && !backwardsMode, delta)
+	minimum := int64(compressions) * zx0.MinMemory(max(threads/compressions, 1))
+	if maxMemory > 0 && maxMemory < minimum {
+		return fmt.Errorf("Memory budget of %d bytes too small, at least %d bytes needed", maxMemory, minimum)
+	}
+	return nil
+}
+
+// checkOptions reports combinations of options that can't be used together,
+// once the configuration overrides of the file processed are applied. The
+// memory budget is checked for the threads given.
+func checkOptions(o *Options, threads int) error {
+	if o.BestMode && (o.Decompress || o.BackwardsMode || o.ClassicMode || o.RomSize != "" || o.XexMode) {
+		return fmt.Errorf("Best mode chooses the format and direction of compressed files")
+	}
+	if !o.Decompress && (o.Level < zx0.LEVEL_FASTEST || o.Level > zx0.LEVEL_OPTIMAL) {
+		return fmt.Errorf("Compression level must be from %d to %d", zx0.LEVEL_FASTEST, zx0.LEVEL_OPTIMAL)
+	}
+	if !o.Decompress {
+		compressions := 1
+		if o.BestMode {
+			compressions = 2
+		}
+		if err := checkMaxMemory(o.MaxMemory, threads, compressions); err != nil {
+			return err
+		}
+	}
+	if o.Checkpoint != "" && (o.Decompress || o.BestMode || o.BlockSize > 0 || o.XexMode) {
+		return fmt.Errorf("Checkpoints only supported compressing a single stream")
+	}
+	if o.Decompress && o.Skip > 0 {
+		return fmt.Errorf("Decompressing with suffix not supported")
+	}
+	if o.RomSize != "" && (o.Decompress || o.BackwardsMode || o.ClassicMode || o.Skip > 0) {
+		return fmt.Errorf("ROM requires forward compression in current file format")
+	}
+	if o.XexMode && (o.Decompress || o.BackwardsMode || o.ClassicMode || o.Skip > 0) {
+		return fmt.Errorf("Atari executables require forward compression in current file format")
+	}
+	return checkBlocks(o)
+}
+
+// checkBatch reports options that only apply to a single file.
+func checkBatch(o *Options) error {
+	if o.Checkpoint != "" || o.StdoutMode || o.AmsdosMode || o.BloadMode || o.Plus3dosMode || o.RomSize != "" || o.XexMode ||
+		o.DskName != "" || o.TrdName != "" || o.SclName != "" {
+		return fmt.Errorf("Headers, disk images, ROMs, checkpoints and standard output not supported in batch mode")
+	}
+	return nil
 }
 
 func dzx0Fn(input []byte, backwardsMode, classicMode bool) ([]byte, error) {
+	if container, err := zx0.ParseContainer(input); err == nil && !backwardsMode {
+		return container.Decompress(0)
+	}
 	return zx0.NewDecompressor().Decompress(input, backwardsMode, !classicMode && !backwardsMode)
 }
 
 func main() {
-	fmt.Println("ZX0 v2.2: Optimal data compressor by Einar Saukas")
-	fmt.Println("Ported to Go by Artur 'Mojzesh' Torun")
-
-	// process optional parameters
-	var threads int
-	var forcedMode, classicMode, backwardsMode, quickMode, decompress bool
-	var skip int
-
-	flag.IntVar(&threads, "p", DEFAULT_THREADS, "Parallel processing with N threads, if p <= 0\nthen all available CPUs are used")
-	flag.BoolVar(&forcedMode, "f", false, "Force overwrite of output file")
-	flag.BoolVar(&classicMode, "c", false, "Classic file format (v1.*)")
-	flag.BoolVar(&backwardsMode, "b", false, "Compress backwards")
-	flag.BoolVar(&quickMode, "q", false, "Quick non-optimal compression")
-	flag.BoolVar(&decompress, "d", false, "Decompress")
-	flag.IntVar(&skip, "s", 0, "Skip N bytes")
-	flag.Parse()
-
-	args := flag.Args()
+	fmt.Fprintf(os.Stderr, "ZX0 v%s: Optimal data compressor by Einar Saukas\n", VERSION)
+	fmt.Fprintln(os.Stderr, "Ported to Go by Artur 'Mojzesh' Torun")
+
+	if len(os.Args) > 1 {
+		if command := findCommand(os.Args[1]); command != nil {
+			command.Run(os.Args[2:])
+			return
+		}
+	}
+	legacy(os.Args[1:])
+}
+
+// process compresses or decompresses a single file, or a batch of files,
+// according to the options given.
+func process(o *Options, config fileConfig, args []string, usage func()) {
+	if !o.BatchMode && len(args) > 0 {
+		o.BatchMode = len(args) > 2
+		for _, arg := range args {
+			o.BatchMode = o.BatchMode || isBatchArgument(arg)
+		}
+	}
+
+	if o.BatchMode {
+		if err := checkBatch(o); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		inputs, err := expandBatchInputs(args, o.Decompress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !batch(inputs, o, config) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(args) < 1 || len(args) > 2 {
-		fmt.Println("Usage: zx0 [-pN] [-f] [-c] [-b] [-q] [-d] input [output.zx0]")
+		usage()
 		os.Exit(1)
 	}
 
-	if decompress && skip > 0 {
-		fmt.Println("Error: Decompressing with suffix not supported")
+	// apply configuration overrides for the input file, checked like any
+	// other option
+	if args[0] != "-" {
+		o = config(args[0])
+	}
+
+	if err := checkOptions(o, o.Threads); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
+	// collect garbage as needed to keep within the memory budget, which
+	// batches give to each file instead
+	if o.MaxMemory > 0 && !o.Decompress {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		debug.SetMemoryLimit(int64(stats.HeapAlloc) + o.MaxMemory)
+	}
+
 	// determine output filename
 	var outputName string
 	if len(args) == 1 {
-		if !decompress {
+		if args[0] == "-" {
+			outputName = "-"
+		} else if o.RomSize != "" {
+			outputName = args[0] + ".rom"
+		} else if o.XexMode {
+			outputName = strings.TrimSuffix(args[0], ".xex") + ".zx0.xex"
+		} else if !o.Decompress {
 			outputName = args[0] + ".zx0"
 		} else {
 			if len(args[0]) > 4 && args[0][len(args[0])-4:] == ".zx0" {
 				outputName = args[0][:len(args[0])-4]
 			} else {
-				fmt.Println("Error: Cannot infer output filename")
+				fmt.Fprintln(os.Stderr, "Error: Cannot infer output filename")
 				os.Exit(1)
 			}
 		}
@@ -113,33 +222,158 @@ func main() {
 		outputName = args[1]
 	}
 
+	if outputName == "-" && (o.DskName != "" || o.TrdName != "" || o.SclName != "") {
+		fmt.Fprintln(os.Stderr, "Error: Disk images require an output filename")
+		os.Exit(1)
+	}
+
+	// "-" reads from standard input and writes to standard output
+	writeName := outputName
+	if o.StdoutMode {
+		writeName = "-"
+	}
+
 	// read input file
-	input, err := os.ReadFile(args[0])
+	input, err := readFile(args[0])
 	if err != nil {
-		fmt.Printf("Error: Cannot read input file %s\n", args[0])
+		fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", args[0])
 		os.Exit(1)
 	}
 
+	// conditionally strip AMSDOS header
+	var amsdosHeader *formats.AmsdosHeader
+	if o.AmsdosMode {
+		amsdosHeader, input = formats.StripAmsdosHeader(input)
+		if amsdosHeader == nil {
+			fmt.Fprintf(os.Stderr, "Error: Missing AMSDOS header in input file %s\n", args[0])
+			os.Exit(1)
+		}
+	}
+
+	// conditionally strip BLOAD header
+	var bloadHeader *formats.BloadHeader
+	if o.BloadMode {
+		bloadHeader, input = formats.StripBloadHeader(input)
+		if bloadHeader == nil {
+			fmt.Fprintf(os.Stderr, "Error: Missing BLOAD header in input file %s\n", args[0])
+			os.Exit(1)
+		}
+	}
+
+	// conditionally strip +3DOS header
+	var plus3dosHeader *formats.Plus3dosHeader
+	if o.Plus3dosMode {
+		plus3dosHeader, input = formats.StripPlus3dosHeader(input)
+		if plus3dosHeader == nil {
+			fmt.Fprintf(os.Stderr, "Error: Missing +3DOS header in input file %s\n", args[0])
+			os.Exit(1)
+		}
+	}
+
+	// apply explicit load and execution addresses
+	if o.LoadAddress >= 0 {
+		if amsdosHeader != nil {
+			amsdosHeader.LoadAddress = o.LoadAddress
+		}
+		if bloadHeader != nil {
+			bloadHeader.Start = o.LoadAddress
+		}
+		if plus3dosHeader != nil {
+			plus3dosHeader.Param1 = o.LoadAddress
+		}
+	} else if bloadHeader != nil {
+		o.LoadAddress = bloadHeader.Start
+	} else if plus3dosHeader != nil {
+		o.LoadAddress = plus3dosHeader.Param1
+	}
+	if o.ExecAddress >= 0 {
+		if amsdosHeader != nil {
+			amsdosHeader.ExecAddress = o.ExecAddress
+		}
+		if bloadHeader != nil {
+			bloadHeader.Exec = o.ExecAddress
+		}
+	} else if bloadHeader != nil {
+		o.ExecAddress = bloadHeader.Exec
+	} else {
+		o.ExecAddress = o.LoadAddress
+	}
+
 	// determine input size
 	if len(input) == 0 {
-		fmt.Printf("Error: Empty input file %s\n", args[0])
+		fmt.Fprintf(os.Stderr, "Error: Empty input file %s\n", args[0])
 		os.Exit(1)
 	}
 
-	// validate skip against input size
-	if skip >= len(input) {
-		fmt.Printf("Error: Skipping entire input file %s\n", args[0])
+	// validate o.Skip against input size
+	if o.Skip >= len(input) {
+		fmt.Fprintf(os.Stderr, "Error: Skipping entire input file %s\n", args[0])
 		os.Exit(1)
 	}
 
 	// check output file
-	if !forcedMode && fileExists(outputName) {
-		fmt.Printf("Error: Already existing output file %s\n", outputName)
+	if !o.ForcedMode && writeName != "-" && fileExists(outputName) {
+		fmt.Fprintf(os.Stderr, "Error: Already existing output file %s\n", outputName)
 		os.Exit(1)
 	}
 
+	threads := o.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	if o.Decompress {
+		threads = 1
+	}
+	result := newFileResult(args[0], o, threads)
+	result.Output = writeName
+	result.InputSize = len(input)
+	start := time.Now()
+
+	// compress Atari executables segment by segment
+	if o.XexMode {
+		output, err := compressXex(input, o.XexDecoder, o.XexZeroPage, o.XexMerge, o.level(), o.Threads, o.MaxMemory, &result.PeakMemory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v: %s\n", err, args[0])
+			os.Exit(1)
+		}
+		if err := writeFile(writeName, output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", outputName)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "File compressed from %d to %d bytes!\n", len(input), len(output))
+		if o.JsonMode {
+			result.OutputSize, result.Elapsed = len(output), time.Since(start).Seconds()
+			result.printJson(o)
+		}
+		return
+	}
+
+	// reuse the output of an identical compression, if cached
+	var best *BestCandidate
+	cacheName := ""
+	if !o.Decompress && !o.NoCache {
+		cacheName = cacheKey(input, o)
+		best = readCache(cacheName)
+		result.Cached = best != nil
+	}
+
+	// conditionally choose the mode producing the smallest output
+	if best != nil {
+		fmt.Fprintf(os.Stderr, "Using cached output for %s\n", args[0])
+		o.BackwardsMode, o.ClassicMode = best.Backwards, best.Classic
+		result.Backwards, result.Classic = best.Backwards, best.Classic
+	} else if o.BestMode {
+		best, err = compressBest(input, o, o.Threads, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		o.BackwardsMode, o.ClassicMode = best.Backwards, best.Classic
+		result.Backwards, result.Classic = best.Backwards, best.Classic
+	}
+
 	// conditionally reverse input file
-	if backwardsMode {
+	if o.BackwardsMode {
 		reverse(input)
 	}
 
@@ -147,52 +381,145 @@ func main() {
 	var output []byte
 	delta := []int{0}
 
-	if !decompress {
-		output = zx0Fn(input, skip, backwardsMode, classicMode, quickMode, threads, true, delta)
+	if !o.Decompress {
+		if best != nil {
+			output, delta[0] = best.Output, best.Delta
+			result.PeakMemory = best.PeakMemory
+		} else if o.BlockSize > 0 {
+			output = compressBlocks(input, o, o.Threads, !o.JsonMode)
+		} else {
+			optimizer := zx0.NewOptimizer()
+			optimizer.SetLevel(o.level())
+			optimizer.SetMaxMemory(o.MaxMemory)
+			if o.Checkpoint != "" {
+				optimizer.SetCheckpoint(o.Checkpoint, o.CheckpointEvery)
+			}
+			output = compressFn(optimizer, input, o.Skip, o.BackwardsMode, o.ClassicMode, o.Threads, !o.JsonMode, delta, &result.PeakMemory)
+		}
+		result.Elapsed = time.Since(start).Seconds()
+		if o.VerifyMode {
+			result.verify(input, output)
+			if result.Verified != nil && !*result.Verified {
+				fmt.Fprintf(os.Stderr, "Error: Verification failed for %s\n", args[0])
+				os.Exit(1)
+			}
+		}
+		if cacheName != "" && !result.Cached {
+			writeCache(cacheName, &BestCandidate{o.BackwardsMode, o.ClassicMode, output, delta[0], 0})
+		}
 	} else {
-		output, err = dzx0Fn(input, backwardsMode, classicMode)
+		output, err = dzx0Fn(input, o.BackwardsMode, o.ClassicMode)
 		if err != nil {
-			fmt.Printf("Error: Invalid input file %s\n", args[0])
+			fmt.Fprintf(os.Stderr, "Error: Invalid input file %s\n", args[0])
 			os.Exit(1)
 		}
+		result.Elapsed = time.Since(start).Seconds()
 	}
 
 	// conditionally reverse output file
-	if backwardsMode {
+	if o.BackwardsMode {
 		reverse(output)
 	}
 
+	// conditionally regenerate AMSDOS and BLOAD headers, or build ROM
+	outputData := output
+	if o.RomSize != "" {
+		outputData, err = buildMsxRom(output, o.LoadAddress, o.ExecAddress, len(input), o.RomSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if o.BloadMode && o.RomSize == "" {
+		outputData = bloadHeader.Wrap(outputData)
+	}
+	if o.Plus3dosMode {
+		outputData = plus3dosHeader.Wrap(outputData)
+	}
+	if o.AmsdosMode {
+		amsdosHeader.Name, amsdosHeader.Extension = formats.SplitFilename83(outputName)
+		outputData = amsdosHeader.Wrap(outputData)
+	}
+
 	// write output file
-	err = os.WriteFile(outputName, output, 0644)
+	err = writeFile(writeName, outputData)
 	if err != nil {
-		fmt.Printf("Error: Cannot write output file %s\n", outputName)
+		fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", outputName)
 		os.Exit(1)
 	}
 
+	// conditionally store output file on disk image
+	if o.DskName != "" {
+		err = addToDsk(o.DskName, o.DskFormat, o.DskExtended, o.ForcedMode, outputName, outputData, o.LoadAddress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if o.TrdName != "" {
+		err = addToTrd(o.TrdName, o.ForcedMode, outputName, outputData, o.LoadAddress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if o.SclName != "" {
+		err = addToScl(o.SclName, o.ForcedMode, outputName, outputData, o.LoadAddress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	var backwardsModeStr string
-	if backwardsMode {
+	if o.BackwardsMode {
 		backwardsModeStr = "backwards "
 	} else {
 		backwardsModeStr = ""
 	}
 
 	// done!
-	if !decompress {
+	if !o.Decompress {
 		var compTypeStr string
-		if skip > 0 {
+		if o.Skip > 0 {
 			compTypeStr = "partially "
 		} else {
 			compTypeStr = ""
 		}
-		fmt.Printf("File %scompressed %sfrom %d to %d bytes! (delta %d)\n",
+		fmt.Fprintf(os.Stderr, "File %scompressed %sfrom %d to %d bytes! (delta %d)\n",
 			compTypeStr,
 			backwardsModeStr,
-			len(input)-skip, len(output), delta[0])
+			len(input)-o.Skip, len(output), delta[0])
+		if result.PeakMemory > 0 {
+			fmt.Fprintf(os.Stderr, "Peak memory: %.1fMB\n", megabytes(uint64(result.PeakMemory)))
+		}
 	} else {
-		fmt.Printf("File decompressed %sfrom %d to %d bytes!\n",
+		fmt.Fprintf(os.Stderr, "File decompressed %sfrom %d to %d bytes!\n",
 			backwardsModeStr,
-			len(input)-skip, len(output))
+			len(input)-o.Skip, len(output))
+	}
+
+	if o.JsonMode {
+		result.OutputSize, result.Delta = len(output), delta[0]
+		result.printJson(o)
+	}
+}
+
+// readFile reads the named file, or standard input if the name is "-".
+func readFile(filename string) ([]byte, error) {
+	if filename == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filename)
+}
+
+// writeFile writes the named file, or standard output if the name is "-".
+func writeFile(filename string, data []byte) error {
+	if filename == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
 	}
+	return os.WriteFile(filename, data, 0644)
 }
 
 func fileExists(filename string) bool {
@@ -0,0 +1,346 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// PackEntry is a region of memory to be compressed into a pack archive.
+type PackEntry struct {
+	File      string
+	Load      int
+	Label     string
+	Bank      int
+	Backwards bool
+	Classic   bool
+	Quick     bool
+	Level     int
+}
+
+// Manifest describes the contents of a pack archive.
+type Manifest struct {
+	Output  string
+	Include string
+	Entries []*PackEntry
+}
+
+// manifestLine is a non-blank line of a manifest with its indentation.
+type manifestLine struct {
+	number  int
+	indent  int
+	content string
+}
+
+// ReadManifest loads a pack manifest, written in a small subset of YAML:
+//
+//	output: game.pak
+//	include: game.inc
+//	entries:
+//	  - file: code.bin
+//	    load: 0x8000
+//	  - file: music.bin
+//	    load: 0xc000
+//	    bank: 3
+//	    backwards: true
+//
+// File names are relative to the directory of the manifest, and "-" stands
+// for standard output.
+func ReadManifest(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read manifest %s", filename)
+	}
+	lines := []manifestLine{}
+	for number, line := range strings.Split(strings.ReplaceAll(string(data), "\t", "    "), "\n") {
+		content := stripComment(line)
+		if strings.TrimSpace(content) == "" || strings.TrimSpace(content) == "---" {
+			continue
+		}
+		trimmed := strings.TrimLeft(content, " ")
+		lines = append(lines, manifestLine{number + 1, len(content) - len(trimmed), strings.TrimRight(trimmed, " \r")})
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("Empty manifest %s", filename)
+	}
+	value, rest, err := parseManifestBlock(lines, lines[0].indent)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("line %d: unexpected indentation", rest[0].number)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s, %v", filename, err)
+	}
+	manifest, err := newManifest(value, filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s, %v", filename, err)
+	}
+
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if manifest.Output == "" {
+		manifest.Output = base + ".pak"
+	}
+	if manifest.Include == "" {
+		manifest.Include = base + ".inc"
+	}
+	return manifest, nil
+}
+
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0:
+			if line[i] == quote {
+				quote = 0
+			}
+		case line[i] == '"' || line[i] == '\'':
+			quote = line[i]
+		case line[i] == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseManifestBlock parses the mapping or list starting at the first line,
+// returning it along with the lines following it.
+func parseManifestBlock(lines []manifestLine, indent int) (any, []manifestLine, error) {
+	if lines[0].content == "-" || strings.HasPrefix(lines[0].content, "- ") {
+		list := []any{}
+		for len(lines) > 0 && lines[0].indent == indent && (lines[0].content == "-" || strings.HasPrefix(lines[0].content, "- ")) {
+			item := strings.TrimLeft(lines[0].content[1:], " ")
+			if item == "" {
+				if len(lines) < 2 || lines[1].indent <= indent {
+					return nil, nil, fmt.Errorf("line %d: missing list item", lines[0].number)
+				}
+				value, rest, err := parseManifestBlock(lines[1:], lines[1].indent)
+				if err != nil {
+					return nil, nil, err
+				}
+				list, lines = append(list, value), rest
+			} else if isManifestKey(item) {
+				// the item is a mapping continuing at the indentation of its first key
+				itemIndent := indent + len(lines[0].content) - len(item)
+				nested := append([]manifestLine{{lines[0].number, itemIndent, item}}, lines[1:]...)
+				value, rest, err := parseManifestBlock(nested, itemIndent)
+				if err != nil {
+					return nil, nil, err
+				}
+				list, lines = append(list, value), rest
+			} else {
+				list, lines = append(list, unquote(item)), lines[1:]
+			}
+		}
+		return list, lines, nil
+	}
+
+	mapping := map[string]any{}
+	for len(lines) > 0 && lines[0].indent == indent {
+		line := lines[0]
+		if !isManifestKey(line.content) {
+			return nil, nil, fmt.Errorf("line %d: expected key: value", line.number)
+		}
+		colon := strings.Index(line.content, ":")
+		key := strings.TrimSpace(line.content[:colon])
+		value := strings.TrimSpace(line.content[colon+1:])
+		if _, exists := mapping[key]; exists {
+			return nil, nil, fmt.Errorf("line %d: duplicate key %s", line.number, key)
+		}
+		lines = lines[1:]
+		if value != "" {
+			mapping[key] = unquote(value)
+			continue
+		}
+		// nested block, lists may also start at the indentation of their key
+		if len(lines) > 0 && (lines[0].indent > indent ||
+			lines[0].indent == indent && (lines[0].content == "-" || strings.HasPrefix(lines[0].content, "- "))) {
+			nested, rest, err := parseManifestBlock(lines, lines[0].indent)
+			if err != nil {
+				return nil, nil, err
+			}
+			mapping[key], lines = nested, rest
+		} else {
+			mapping[key] = ""
+		}
+	}
+	if len(lines) > 0 && lines[0].indent > indent {
+		return nil, nil, fmt.Errorf("line %d: unexpected indentation", lines[0].number)
+	}
+	return mapping, lines, nil
+}
+
+func isManifestKey(content string) bool {
+	colon := strings.Index(content, ":")
+	return colon > 0 && content[0] != '"' && content[0] != '\'' &&
+		(colon == len(content)-1 || content[colon+1] == ' ')
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func newManifest(value any, directory string) (*Manifest, error) {
+	root, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping")
+	}
+	manifest := &Manifest{}
+	for key, value := range root {
+		var err error
+		switch key {
+		case "output":
+			manifest.Output, err = manifestPath(value, directory)
+		case "include":
+			manifest.Include, err = manifestPath(value, directory)
+		case "entries":
+			items, ok := value.([]any)
+			if !ok {
+				return nil, fmt.Errorf("entries must be a list")
+			}
+			for i, item := range items {
+				entry, err := newPackEntry(item, directory)
+				if err != nil {
+					return nil, fmt.Errorf("entry %d, %v", i+1, err)
+				}
+				manifest.Entries = append(manifest.Entries, entry)
+			}
+		default:
+			err = fmt.Errorf("unknown key %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(manifest.Entries) == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+	return manifest, nil
+}
+
+func newPackEntry(value any, directory string) (*PackEntry, error) {
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping")
+	}
+	entry := &PackEntry{Load: -1, Bank: -1, Level: zx0.LEVEL_OPTIMAL}
+	for key, value := range fields {
+		scalar, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a single value", key)
+		}
+		var err error
+		switch key {
+		case "file":
+			entry.File, err = manifestPath(value, directory)
+		case "label":
+			entry.Label = scalar
+		case "load":
+			entry.Load, err = parseAddress(scalar)
+		case "bank":
+			entry.Bank, err = parseAddress(scalar)
+		case "backwards":
+			entry.Backwards, err = parseManifestBool(scalar)
+		case "classic":
+			entry.Classic, err = parseManifestBool(scalar)
+		case "quick":
+			entry.Quick, err = parseManifestBool(scalar)
+		case "level":
+			entry.Level, err = parseLevel(scalar)
+		default:
+			err = fmt.Errorf("unknown key %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if entry.File == "" {
+		return nil, fmt.Errorf("missing file")
+	}
+	if entry.Load < 0 || entry.Load > 0xffff {
+		return nil, fmt.Errorf("missing or invalid load address")
+	}
+	return entry, nil
+}
+
+func manifestPath(value any, directory string) (string, error) {
+	path, ok := value.(string)
+	if !ok || path == "" {
+		return "", fmt.Errorf("expected a file name")
+	}
+	if path == "-" || filepath.IsAbs(path) {
+		return path, nil
+	}
+	return filepath.Join(directory, path), nil
+}
+
+// parseAddress accepts decimal numbers and hexadecimal ones prefixed by "0x",
+// "$" or "#".
+func parseAddress(s string) (int, error) {
+	if strings.HasPrefix(s, "$") || strings.HasPrefix(s, "#") {
+		s = "0x" + s[1:]
+	}
+	value, err := strconv.ParseInt(s, 0, 32)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	return int(value), nil
+}
+
+func parseManifestBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %s", s)
+}
+
+func parseLevel(s string) (int, error) {
+	level, err := strconv.Atoi(s)
+	if err != nil || level < zx0.LEVEL_FASTEST || level > zx0.LEVEL_OPTIMAL {
+		return 0, fmt.Errorf("invalid compression level %s", s)
+	}
+	return level, nil
+}
+
+// level returns the compression level of an entry, quick compression
+// replacing the optimal levels like it does on the command line.
+func (e *PackEntry) level() int {
+	if e.Quick && e.Level > zx0.LEVEL_HEURISTIC {
+		return zx0.LEVEL_QUICK
+	}
+	return e.Level
+}
@@ -0,0 +1,198 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+const (
+	PACK_ENTRY_SIZE  = 6
+	PACK_MAX_ENTRIES = 255
+)
+
+// pack compresses every entry of a manifest into a single archive starting
+// with a directory: the number of entries (1 byte) followed by a record per
+// entry of destination address, source offset within the archive and
+// compressed length (16-bit little endian each). Records of backwards
+// entries point to the last byte of the destination and the compressed data,
+// as expected by backwards decompressors. Labels for every entry are written
+// to an assembler include file.
+func pack(arguments []string) {
+	flags := newFlagSet("pack")
+	threads := flags.Int("p", DEFAULT_THREADS, "Parallel processing with N threads, if p <= 0\nthen all available CPUs are used")
+	forcedMode := flags.Bool("f", false, "Force overwrite of output files")
+	flags.Parse(arguments)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	manifestName := flags.Arg(0)
+
+	manifest, err := ReadManifest(manifestName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(manifest.Entries) > PACK_MAX_ENTRIES {
+		fmt.Fprintf(os.Stderr, "Error: Too many entries in manifest %s\n", manifestName)
+		os.Exit(1)
+	}
+
+	// check output files
+	for _, name := range []string{manifest.Output, manifest.Include} {
+		if !*forcedMode && name != "-" && fileExists(name) {
+			fmt.Fprintf(os.Stderr, "Error: Already existing output file %s\n", name)
+			os.Exit(1)
+		}
+	}
+
+	labels := map[string]bool{}
+	table := []byte{byte(len(manifest.Entries))}
+	blobs := []byte{}
+	include := fmt.Sprintf("; Generated by zx0 pack from %s\n\nPACK_COUNT EQU %d\n", filepath.Base(manifestName), len(manifest.Entries))
+	offset := 1 + len(manifest.Entries)*PACK_ENTRY_SIZE
+	for i, entry := range manifest.Entries {
+		label := packLabel(entry, i)
+		if labels[label] {
+			fmt.Fprintf(os.Stderr, "Error: Duplicate label %s in manifest %s\n", label, manifestName)
+			os.Exit(1)
+		}
+		labels[label] = true
+
+		input, err := os.ReadFile(entry.File)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", entry.File)
+			os.Exit(1)
+		}
+		if len(input) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: Empty input file %s\n", entry.File)
+			os.Exit(1)
+		}
+		if entry.Load+len(input) > 0x10000 {
+			fmt.Fprintf(os.Stderr, "Error: Input file %s doesn't fit at address 0x%04X\n", entry.File, entry.Load)
+			os.Exit(1)
+		}
+
+		// compress entry
+		delta := []int{0}
+		if entry.Backwards {
+			reverse(input)
+		}
+		output := zx0Fn(input, 0, entry.Backwards, entry.Classic, entry.level(), *threads, 0, false, delta, nil)
+		if entry.Backwards {
+			reverse(output)
+		}
+		if offset+len(output) > 0x10000 {
+			fmt.Fprintf(os.Stderr, "Error: Archive exceeds 64K at input file %s\n", entry.File)
+			os.Exit(1)
+		}
+
+		destination, source := entry.Load, offset
+		if entry.Backwards {
+			destination += len(input) - 1
+			source += len(output) - 1
+		}
+		table = append(table,
+			byte(destination), byte(destination>>8),
+			byte(source), byte(source>>8),
+			byte(len(output)), byte(len(output)>>8))
+		blobs = append(blobs, output...)
+
+		include += fmt.Sprintf("\n; %s%s\n", filepath.Base(entry.File), packModes(entry))
+		include += fmt.Sprintf("%s_DEST EQU $%04X\n", label, destination)
+		include += fmt.Sprintf("%s_OFFSET EQU $%04X\n", label, source)
+		include += fmt.Sprintf("%s_LENGTH EQU %d\n", label, len(output))
+		include += fmt.Sprintf("%s_SIZE EQU %d\n", label, len(input))
+		include += fmt.Sprintf("%s_DELTA EQU %d\n", label, delta[0])
+		if entry.Bank >= 0 {
+			include += fmt.Sprintf("%s_BANK EQU %d\n", label, entry.Bank)
+		}
+
+		fmt.Fprintf(os.Stderr, "%s: compressed %sfrom %d to %d bytes at 0x%04X! (delta %d)\n",
+			entry.File, strings.TrimPrefix(packModes(entry)+" ", " "), len(input), len(output), entry.Load, delta[0])
+		offset += len(output)
+	}
+
+	// write output files
+	if err := writeFile(manifest.Output, append(table, blobs...)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", manifest.Output)
+		os.Exit(1)
+	}
+	if err := writeFile(manifest.Include, []byte(include)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot write output file %s\n", manifest.Include)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Packed %d entries into %d bytes!\n", len(manifest.Entries), offset)
+}
+
+// packLabel returns the assembler label prefix of an entry, derived from its
+// file name unless given in the manifest.
+func packLabel(entry *PackEntry, index int) string {
+	name := entry.Label
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(entry.File), filepath.Ext(entry.File))
+	}
+	label := []byte{}
+	for _, c := range []byte(strings.ToUpper(name)) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			label = append(label, c)
+		} else {
+			label = append(label, '_')
+		}
+	}
+	if len(label) == 0 {
+		return fmt.Sprintf("ENTRY%d", index+1)
+	}
+	if label[0] >= '0' && label[0] <= '9' {
+		label = append([]byte{'_'}, label...)
+	}
+	return string(label)
+}
+
+func packModes(entry *PackEntry) string {
+	modes := ""
+	if entry.Backwards {
+		modes += " backwards"
+	}
+	if entry.Classic {
+		modes += " classic"
+	}
+	if entry.Quick {
+		modes += " quick"
+	}
+	if entry.Level < zx0.LEVEL_OPTIMAL {
+		modes += fmt.Sprintf(" level %d", entry.Level)
+	}
+	return modes
+}
@@ -0,0 +1,101 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// FileResult is the outcome of processing a single file, also reported as a
+// JSON record by "-json".
+type FileResult struct {
+	Input      string  `json:"input"`
+	Output     string  `json:"output,omitempty"`
+	InputSize  int     `json:"input_size"`
+	Skip       int     `json:"skip"`
+	OutputSize int     `json:"output_size"`
+	Delta      int     `json:"delta"`
+	Decompress bool    `json:"decompress"`
+	Backwards  bool    `json:"backwards"`
+	Classic    bool    `json:"classic"`
+	Quick      bool    `json:"quick"`
+	Level      int     `json:"level,omitempty"`
+	Threads    int     `json:"threads"`
+	Elapsed    float64 `json:"elapsed"`
+	PeakMemory int64   `json:"peak_memory,omitempty"`
+	Verified   *bool   `json:"verified,omitempty"`
+	Cached     bool    `json:"cached,omitempty"`
+	Err        error   `json:"-"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// newFileResult starts the result of processing a file, the compression
+// level only applying when compressing.
+func newFileResult(input string, o *Options, threads int) *FileResult {
+	level := 0
+	if !o.Decompress {
+		level = o.level()
+	}
+	return &FileResult{
+		Input:      input,
+		Skip:       o.Skip,
+		Decompress: o.Decompress,
+		Backwards:  o.BackwardsMode,
+		Classic:    o.ClassicMode,
+		Quick:      o.QuickMode,
+		Level:      level,
+		Threads:    threads,
+	}
+}
+
+// verify checks that compressed data, in the same direction as the input
+// given, decompresses back to it. Partial compression is not verified, as
+// the decompressor can't access the skipped bytes.
+func (r *FileResult) verify(input, output []byte) {
+	if r.Decompress || r.Skip > 0 {
+		return
+	}
+	decompressed, err := dzx0Fn(output, r.Backwards, r.Classic)
+	verified := err == nil && bytes.Equal(decompressed, input)
+	r.Verified = &verified
+}
+
+// printJson writes the result as a single line of JSON, to standard output
+// unless it's used for data.
+func (r *FileResult) printJson(o *Options) {
+	if r.Err != nil {
+		r.Error = r.Err.Error()
+	}
+	record, _ := json.Marshal(r)
+	if o.StdoutMode || r.Output == "-" {
+		fmt.Fprintln(os.Stderr, string(record))
+	} else {
+		fmt.Println(string(record))
+	}
+}
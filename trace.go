@@ -0,0 +1,101 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/mojzesh/zx0-go/zx0"
+)
+
+// traceCommand prints every token of a compressed stream, either read from
+// a compressed file or written while compressing a file with "-encode". Both
+// traces have the same format, so they can be compared with diff.
+func traceCommand(arguments []string) {
+	o := &Options{}
+	var encode bool
+	flags := newFlagSet("trace")
+	flags.BoolVar(&encode, "encode", false, "Compress input and trace the tokens written")
+	o.threadFlags(flags)
+	o.levelFlags(flags)
+	o.formatFlags(flags)
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	filename := flags.Arg(0)
+
+	input, err := readFile(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", filename)
+		os.Exit(1)
+	}
+	if len(input) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: Empty input file %s\n", filename)
+		os.Exit(1)
+	}
+	if o.BackwardsMode {
+		reverse(input)
+	}
+
+	tokens := []zx0.Token{}
+	tracer := func(token zx0.Token) {
+		tokens = append(tokens, token)
+	}
+	invertMode := !o.ClassicMode && !o.BackwardsMode
+	var compressedSize, decompressedSize int
+	if encode {
+		optimizer := zx0.NewOptimizer()
+		optimizer.SetLevel(o.level())
+		compressor := zx0.NewCompressor()
+		compressor.SetTracer(tracer)
+		output := compressor.Compress(optimizer.Optimize(input, 0, MAX_OFFSET_ZX0, o.Threads, false),
+			input, 0, o.BackwardsMode, invertMode, []int{0})
+		compressedSize, decompressedSize = len(output), len(input)
+	} else {
+		decompressor := zx0.NewDecompressor()
+		decompressor.SetTracer(tracer)
+		output, err := decompressor.Decompress(input, o.BackwardsMode, invertMode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid input file %s (%v)\n", filename, err)
+			os.Exit(1)
+		}
+		compressedSize, decompressedSize = len(input), len(output)
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	fmt.Fprintf(writer, "%8s  %-11s  details\n", "bit", "token")
+	for _, token := range tokens {
+		if o.BackwardsMode {
+			token = token.Reversed(compressedSize, decompressedSize)
+		}
+		fmt.Fprintln(writer, token)
+	}
+}
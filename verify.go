@@ -0,0 +1,91 @@
+/*
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// verifyCommand compresses a file in memory and checks that it decompresses
+// back to the original. Given a compressed file too, it checks that file
+// instead.
+func verifyCommand(arguments []string) {
+	o := &Options{}
+	flags := newFlagSet("verify")
+	o.threadFlags(flags)
+	o.levelFlags(flags)
+	o.formatFlags(flags)
+	flags.Parse(arguments)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	args := flags.Args()
+
+	original, err := readFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", args[0])
+		os.Exit(1)
+	}
+	if len(original) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: Empty input file %s\n", args[0])
+		os.Exit(1)
+	}
+
+	var compressed []byte
+	if len(args) == 2 {
+		compressed, err = readFile(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read input file %s\n", args[1])
+			os.Exit(1)
+		}
+	} else {
+		input := append([]byte{}, original...)
+		if o.BackwardsMode {
+			reverse(input)
+		}
+		compressed = zx0Fn(input, 0, o.BackwardsMode, o.ClassicMode, o.level(), o.Threads, o.MaxMemory, false, []int{0}, nil)
+		if o.BackwardsMode {
+			reverse(compressed)
+		}
+	}
+
+	input := append([]byte{}, compressed...)
+	if o.BackwardsMode {
+		reverse(input)
+	}
+	output, err := dzx0Fn(input, o.BackwardsMode, o.ClassicMode)
+	if err == nil && o.BackwardsMode {
+		reverse(output)
+	}
+	if err != nil || !bytes.Equal(output, original) {
+		fmt.Fprintf(os.Stderr, "Verification FAILED: %d compressed bytes don't decompress to %s\n", len(compressed), args[0])
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Verification OK: %d bytes compressed to %d bytes\n", len(original), len(compressed))
+}
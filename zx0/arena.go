@@ -0,0 +1,144 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	ARENA_CHUNK_BITS  = 14
+	ARENA_CHUNK_SIZE  = 1 << ARENA_CHUNK_BITS
+	ARENA_MAX_CHUNKS  = math.MaxInt32 >> ARENA_CHUNK_BITS
+	ARENA_NODE_SIZE   = int64(unsafe.Sizeof(node{}))
+	ARENA_CHUNK_BYTES = ARENA_CHUNK_SIZE * ARENA_NODE_SIZE
+)
+
+// node is a block stored in the arena. Nodes refer to each other by handle,
+// an index into the arena, so they hold no pointers for the garbage
+// collector to scan. Handle 0 is never allocated and stands for no block.
+type node struct {
+	bits       int32
+	index      int32
+	offset     int32
+	chain      int32 // also links released nodes together
+	references int32
+}
+
+// arena stores the blocks created by the optimizer in fixed-size chunks,
+// which are never moved, so nodes can be read while other chunks are added.
+type arena struct {
+	chunks    []*[ARENA_CHUNK_SIZE]node
+	allocated atomic.Int32
+}
+
+// newArena creates an arena that can hold up to the given number of nodes.
+func newArena(capacity int) *arena {
+	return &arena{chunks: make([]*[ARENA_CHUNK_SIZE]node, min(capacity/ARENA_CHUNK_SIZE+1, ARENA_MAX_CHUNKS))}
+}
+
+func (a *arena) node(handle int32) *node {
+	return &a.chunks[handle>>ARENA_CHUNK_BITS][handle&(ARENA_CHUNK_SIZE-1)]
+}
+
+// chain copies a chain of nodes out of the arena as blocks.
+func (a *arena) chain(handle int32) *Block {
+	var head *Block
+	for tail := &head; handle != 0; handle = a.node(handle).chain {
+		n := a.node(handle)
+		*tail = &Block{int(n.bits), int(n.index), int(n.offset), nil}
+		tail = &(*tail).Chain
+	}
+	return head
+}
+
+// pool allocates nodes for a single thread, taking whole chunks from the
+// arena and reusing the nodes it releases. Reference counts are shared by
+// all threads, so they are updated atomically.
+type pool struct {
+	arena *arena
+	free  int32
+	next  int32
+	limit int32
+}
+
+func newPool(a *arena) *pool {
+	return &pool{arena: a}
+}
+
+// allocate creates a node without references, referring to its chain.
+func (p *pool) allocate(bits, index, offset int, chain int32) int32 {
+	handle := p.free
+	if handle != 0 {
+		p.free = p.arena.node(handle).chain
+	} else {
+		if p.next == p.limit {
+			p.reserve()
+		}
+		handle = p.next
+		p.next++
+	}
+	*p.arena.node(handle) = node{int32(bits), int32(index), int32(offset), chain, 0}
+	if chain != 0 {
+		atomic.AddInt32(&p.arena.node(chain).references, 1)
+	}
+	return handle
+}
+
+func (p *pool) reserve() {
+	chunk := p.arena.allocated.Add(1) - 1
+	if int(chunk) >= len(p.arena.chunks) {
+		panic("zx0: block arena exhausted")
+	}
+	p.arena.chunks[chunk] = new([ARENA_CHUNK_SIZE]node)
+	p.next = chunk << ARENA_CHUNK_BITS
+	p.limit = p.next + ARENA_CHUNK_SIZE
+	if p.next == 0 {
+		p.next++
+	}
+}
+
+// assign makes a reference point to a node, releasing the node it pointed to.
+func (p *pool) assign(reference *int32, handle int32) {
+	atomic.AddInt32(&p.arena.node(handle).references, 1)
+	p.release(*reference)
+	*reference = handle
+}
+
+// release drops a reference to a node. Nodes left without references are
+// reused, releasing their own chains.
+func (p *pool) release(handle int32) {
+	for handle != 0 {
+		n := p.arena.node(handle)
+		if atomic.AddInt32(&n.references, -1) != 0 {
+			return
+		}
+		p.free, handle, n.chain = handle, n.chain, p.free
+	}
+}
@@ -32,3 +32,16 @@ type Block struct {
 	Offset int
 	Chain  *Block
 }
+
+// Sequence returns the blocks of an optimal chain in input order, starting
+// with the initial block, without modifying the chain.
+func (b *Block) Sequence() []*Block {
+	sequence := []*Block{}
+	for block := b; block != nil; block = block.Chain {
+		sequence = append(sequence, block)
+	}
+	for i, j := 0, len(sequence)-1; i < j; i, j = i+1, j-1 {
+		sequence[i], sequence[j] = sequence[j], sequence[i]
+	}
+	return sequence
+}
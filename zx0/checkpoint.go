@@ -0,0 +1,311 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package zx0
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	CHECKPOINT_MAGIC   = "ZX0K"
+	CHECKPOINT_VERSION = 1
+
+	// bits, index, offset and chain of each block
+	CHECKPOINT_NODE_SIZE = 16
+)
+
+// checkpointHeader identifies the compression a checkpoint belongs to, and
+// the last position processed.
+type checkpointHeader struct {
+	Magic     [4]byte
+	Version   uint8
+	Finder    uint8
+	Reserved  uint16
+	Size      uint32
+	Skip      uint32
+	ArraySize uint32
+	Window    uint32
+	Index     uint32
+	Hash      [sha256.Size]byte
+}
+
+// SetCheckpoint makes the optimal parser save its state to a file at the
+// given interval, so a compression stopped halfway can resume from there.
+// The file is only used to resume a compression of the same input with the
+// same settings, giving the same output, and it's removed once done.
+func (o *Optimizer) SetCheckpoint(filename string, interval time.Duration) {
+	o.checkpointName, o.checkpointInterval = filename, interval
+}
+
+func (o *Optimizer) checkpointHeader(input []byte, skip, arraySize, index int) checkpointHeader {
+	header := checkpointHeader{
+		Version:   CHECKPOINT_VERSION,
+		Size:      uint32(len(input)),
+		Skip:      uint32(skip),
+		ArraySize: uint32(arraySize),
+		Window:    uint32(o.window),
+		Index:     uint32(index),
+		Hash:      o.checkpointHash,
+	}
+	copy(header.Magic[:], CHECKPOINT_MAGIC)
+	if o.finder != nil {
+		header.Finder = 1
+	}
+	return header
+}
+
+// checkpoint saves the state of the optimizer after processing an index,
+// if the interval has elapsed since it was last saved.
+func (o *Optimizer) checkpoint(input []byte, skip, arraySize, index int) {
+	if o.checkpointName == "" || time.Since(o.checkpointTime) < o.checkpointInterval || index == len(input)-1 {
+		return
+	}
+	if err := o.saveCheckpoint(o.checkpointHeader(input, skip, arraySize, index)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Cannot write checkpoint file %s (%v)\n", o.checkpointName, err)
+	}
+	o.checkpointTime = time.Now()
+}
+
+// saveCheckpoint writes the blocks reachable from the optimizer state,
+// followed by the state itself, to a temporary file replacing the
+// checkpoint once complete, so a compression stopped while saving still
+// leaves the previous one. Blocks are numbered from 1 in the order written,
+// each one after its chain, and written as soon as they're numbered, the
+// count before them filled in at the end.
+func (o *Optimizer) saveCheckpoint(header checkpointHeader) error {
+	file, err := os.Create(o.checkpointName + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	write := func(data any) {
+		if err == nil {
+			err = binary.Write(writer, binary.LittleEndian, data)
+		}
+	}
+	write(header)
+	write(uint32(0))
+
+	// number the blocks by handle, reusing the list between checkpoints
+	capacity := int(o.arena.allocated.Load()) * ARENA_CHUNK_SIZE
+	if len(o.checkpointIds) < capacity {
+		o.checkpointIds = make([]uint32, capacity)
+	} else {
+		clear(o.checkpointIds)
+	}
+	count := uint32(0)
+	chain := []int32{}
+	var record [CHECKPOINT_NODE_SIZE]byte
+	add := func(handle int32) uint32 {
+		chain = chain[:0]
+		for h := handle; h != 0 && o.checkpointIds[h] == 0; h = o.arena.node(h).chain {
+			chain = append(chain, h)
+		}
+		for i := len(chain) - 1; i >= 0 && err == nil; i-- {
+			n := o.arena.node(chain[i])
+			count++
+			o.checkpointIds[chain[i]] = count
+			binary.LittleEndian.PutUint32(record[0:], uint32(n.bits))
+			binary.LittleEndian.PutUint32(record[4:], uint32(n.index))
+			binary.LittleEndian.PutUint32(record[8:], uint32(n.offset))
+			binary.LittleEndian.PutUint32(record[12:], o.checkpointIds[n.chain])
+			_, err = writer.Write(record[:])
+		}
+		return o.checkpointIds[handle]
+	}
+	roots := func(handles []int32) []uint32 {
+		list := make([]uint32, len(handles))
+		for i, handle := range handles {
+			list[i] = add(handle)
+		}
+		return list
+	}
+	optimal, lastLiteral, lastMatch := roots(o.optimal), roots(o.lastLiteral), roots(o.lastMatch)
+
+	write(optimal)
+	write(lastLiteral)
+	write(lastMatch)
+	write(toInt32(o.matchLength))
+	write(toInt32(o.bestLength))
+	if o.finder != nil {
+		write(o.finder.runEnd)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		var buffer [4]byte
+		binary.LittleEndian.PutUint32(buffer[:], count)
+		_, err = file.WriteAt(buffer[:], int64(binary.Size(header)))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(o.checkpointName+".tmp", o.checkpointName)
+	}
+	if err != nil {
+		os.Remove(o.checkpointName + ".tmp")
+	}
+	return err
+}
+
+// resume loads the state of the optimizer from the checkpoint file, if it
+// exists and belongs to the same compression, returning the last index
+// processed. The match finder is rebuilt from the last match at each
+// offset, which is where its groups of offsets start.
+func (o *Optimizer) resume(input []byte, skip, arraySize int) (int, error) {
+	o.checkpointHash = sha256.Sum256(input)
+	o.checkpointTime = time.Now()
+	file, err := os.Open(o.checkpointName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	read := func(data any) {
+		if err == nil {
+			err = binary.Read(reader, binary.LittleEndian, data)
+		}
+	}
+
+	var header checkpointHeader
+	read(&header)
+	expected := o.checkpointHeader(input, skip, arraySize, int(header.Index))
+	if err != nil {
+		return 0, err
+	}
+	if header != expected || int(header.Index) < skip || int(header.Index) >= len(input) {
+		return 0, fmt.Errorf("checkpoint doesn't match input and settings")
+	}
+	var count uint32
+	read(&count)
+	if err != nil || int(count) >= len(o.arena.chunks)*ARENA_CHUNK_SIZE {
+		return 0, fmt.Errorf("invalid checkpoint")
+	}
+
+	// allocate the blocks as they're read, which the caller drops if the
+	// checkpoint turns out to be invalid
+	handles := make([]int32, count+1)
+	var record [CHECKPOINT_NODE_SIZE]byte
+	for i := 1; i <= int(count) && err == nil; i++ {
+		if _, err = io.ReadFull(reader, record[:]); err != nil {
+			break
+		}
+		chain := binary.LittleEndian.Uint32(record[12:])
+		if chain >= uint32(i) {
+			err = fmt.Errorf("invalid checkpoint")
+			break
+		}
+		handles[i] = o.pools[0].allocate(int(int32(binary.LittleEndian.Uint32(record[0:]))), int(int32(binary.LittleEndian.Uint32(record[4:]))),
+			int(int32(binary.LittleEndian.Uint32(record[8:]))), handles[chain])
+	}
+	optimal, lastLiteral, lastMatch := make([]uint32, len(o.optimal)), make([]uint32, arraySize), make([]uint32, arraySize)
+	matchLength, bestLength := make([]int32, arraySize), make([]int32, len(o.bestLength))
+	read(optimal)
+	read(lastLiteral)
+	read(lastMatch)
+	read(matchLength)
+	read(bestLength)
+	var runEnd []int32
+	if o.finder != nil {
+		runEnd = make([]int32, len(o.finder.runEnd))
+		read(runEnd)
+	}
+	if err == nil {
+		if _, err = reader.ReadByte(); err == io.EOF {
+			err = nil
+		} else {
+			err = fmt.Errorf("invalid checkpoint")
+		}
+	}
+	for _, list := range [][]uint32{optimal, lastLiteral, lastMatch} {
+		for _, id := range list {
+			if id > count {
+				err = fmt.Errorf("invalid checkpoint")
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if o.finder != nil {
+		copy(o.finder.runEnd, runEnd)
+	}
+	for i, id := range optimal {
+		if id != 0 {
+			o.pools[0].assign(&o.optimal[i], handles[id])
+		}
+	}
+	for offset := range lastMatch {
+		if lastLiteral[offset] != 0 {
+			o.pools[0].assign(&o.lastLiteral[offset], handles[lastLiteral[offset]])
+		}
+		if lastMatch[offset] != 0 {
+			o.setLastMatch(o.pools[0], offset, handles[lastMatch[offset]])
+		}
+		o.matchLength[offset] = int(matchLength[offset])
+	}
+	for i, length := range bestLength {
+		o.bestLength[i] = int(length)
+	}
+	if o.finder != nil {
+		groups := map[int][]int64{}
+		for offset := range lastMatch {
+			if lastMatch[offset] != 0 {
+				position := int(o.matchIndex[offset])
+				groups[position] = append(groups[position], groupKey(int(o.matchBits[offset]), position, int32(offset)))
+			}
+		}
+		for position, keys := range groups {
+			o.finder.insert(position, keys)
+		}
+	}
+	return int(header.Index), nil
+}
+
+// removeCheckpoint deletes the checkpoint file of a finished compression.
+func (o *Optimizer) removeCheckpoint() {
+	if o.checkpointName != "" {
+		os.Remove(o.checkpointName)
+	}
+	o.checkpointIds = nil
+}
+
+func toInt32(values []int) []int32 {
+	list := make([]int32, len(values))
+	for i, value := range values {
+		list[i] = int32(value)
+	}
+	return list
+}
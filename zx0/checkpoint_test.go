@@ -0,0 +1,125 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// checkpointInput returns the text of the corpus, long enough to be
+// interrupted after the first checkpoint.
+func checkpointInput(t *testing.T) []byte {
+	for _, file := range testCorpus(t) {
+		if file.name == "text" {
+			return file.input
+		}
+	}
+	t.Fatal("no text in the corpus")
+	return nil
+}
+
+// TestCheckpointResume stops a compression in another process once it saves
+// a checkpoint, and checks that resuming it gives the same output as an
+// uninterrupted compression, with the match finder and scanning every
+// offset.
+func TestCheckpointResume(t *testing.T) {
+	input := checkpointInput(t)
+	if name := os.Getenv("ZX0_TEST_CHECKPOINT"); name != "" {
+		// the process interrupted, compressing until it's killed
+		budget, _ := strconv.ParseInt(os.Getenv("ZX0_TEST_BUDGET"), 10, 64)
+		optimizer := NewOptimizer()
+		optimizer.SetMaxMemory(budget)
+		optimizer.SetCheckpoint(name, time.Millisecond)
+		optimizer.Optimize(input, 0, MAX_OFFSET, 1, false)
+		return
+	}
+
+	for _, budget := range testBudgets[:2] {
+		t.Run(budget.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "test.ckpt")
+			command := exec.Command(os.Args[0], "-test.run=^TestCheckpointResume$", "-test.short="+strconv.FormatBool(testing.Short()))
+			command.Env = append(os.Environ(), "ZX0_TEST_CHECKPOINT="+name,
+				"ZX0_TEST_BUDGET="+strconv.FormatInt(budget.budget(len(input)), 10))
+			if err := command.Start(); err != nil {
+				t.Fatal(err)
+			}
+			for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				if _, err := os.Stat(name); err == nil {
+					break
+				}
+			}
+			command.Process.Kill()
+			command.Wait()
+			if _, err := os.Stat(name); err != nil {
+				t.Fatalf("no checkpoint left by the interrupted compression: %v", err)
+			}
+
+			optimizer := NewOptimizer()
+			optimizer.SetMaxMemory(budget.budget(len(input)))
+			expected := NewCompressor().Compress(optimizer.Optimize(input, 0, MAX_OFFSET, 1, false), input, 0, false, true, []int{0})
+			optimizer.SetCheckpoint(name, time.Hour)
+			messages := captureStderr(t, func() {
+				output := NewCompressor().Compress(optimizer.Optimize(input, 0, MAX_OFFSET, 1, true), input, 0, false, true, []int{0})
+				if !bytes.Equal(output, expected) {
+					t.Errorf("resumed output of %d bytes differs from the %d bytes expected", len(output), len(expected))
+				}
+			})
+			if !bytes.Contains(messages, []byte("Resuming from checkpoint")) {
+				t.Errorf("compression not resumed: %s", messages)
+			}
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("checkpoint left after the compression")
+			}
+		})
+	}
+}
+
+// captureStderr returns what a function writes to standard error.
+func captureStderr(t *testing.T, f func()) []byte {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = writer
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		done <- data
+	}()
+	f()
+	os.Stderr = stderr
+	writer.Close()
+	return <-done
+}
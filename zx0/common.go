@@ -40,9 +40,27 @@ func max(a, b int) int {
 	return b
 }
 
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func btoi(b bool) int {
 	if b {
 		return 1
 	}
 	return 0
 }
+
+// bitNumber returns the position of a single-bit mask within its byte,
+// counting from the most significant bit.
+func bitNumber(mask int) int {
+	number := 0
+	for mask < 128 {
+		mask <<= 1
+		number++
+	}
+	return number
+}
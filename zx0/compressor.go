@@ -34,12 +34,38 @@ type Compressor struct {
 	bitMask     int
 	diff        int
 	backtrack   bool
+
+	tracer     Tracer
+	tokenStart int
+	gammaBits  []byte
 }
 
 func NewCompressor() *Compressor {
 	return &Compressor{}
 }
 
+// SetTracer makes the compressor report every token it writes.
+func (c *Compressor) SetTracer(tracer Tracer) {
+	c.tracer = tracer
+}
+
+// markBit records the position of a bit written, which starts a new token
+// if none is in progress.
+func (c *Compressor) markBit(position int) {
+	if c.tokenStart < 0 {
+		c.tokenStart = position
+	}
+}
+
+// trace reports a token, starting the next one at the following bit.
+func (c *Compressor) trace(token Token) {
+	if c.tracer != nil {
+		token.BitPosition = c.tokenStart
+		c.tracer(token)
+	}
+	c.tokenStart = -1
+}
+
 func (c *Compressor) readBytes(n int, delta []int) {
 	c.inputIndex += n
 	c.diff += n
@@ -59,6 +85,10 @@ func (c *Compressor) writeBit(value int) {
 		if value > 0 {
 			c.output[c.outputIndex-1] |= 1
 		}
+		// the first indicator bit is implicit
+		if c.outputIndex > 0 {
+			c.markBit((c.outputIndex-1)*8 + 7)
+		}
 		c.backtrack = false
 	} else {
 		if c.bitMask == 0 {
@@ -66,6 +96,7 @@ func (c *Compressor) writeBit(value int) {
 			c.bitIndex = c.outputIndex
 			c.writeByte(0)
 		}
+		c.markBit(c.bitIndex*8 + bitNumber(c.bitMask))
 		if value > 0 {
 			c.output[c.bitIndex] |= byte(c.bitMask)
 		}
@@ -79,11 +110,19 @@ func (c *Compressor) writeInterlacedEliasGamma(value int, backwardsMode, invertM
 		i <<= 1
 	}
 	i >>= 1
+	c.gammaBits = c.gammaBits[:0]
 	for i >>= 1; i > 0; i >>= 1 {
-		c.writeBit(btoi(backwardsMode))
-		c.writeBit(btoi(invertMode == ((value & i) == 0)))
+		c.writeGammaBit(btoi(backwardsMode))
+		c.writeGammaBit(btoi(invertMode == ((value & i) == 0)))
+	}
+	c.writeGammaBit(btoi(!backwardsMode))
+}
+
+func (c *Compressor) writeGammaBit(value int) {
+	c.writeBit(value)
+	if c.tracer != nil {
+		c.gammaBits = append(c.gammaBits, byte('0'+value))
 	}
-	c.writeBit(btoi(!backwardsMode))
 }
 
 func (c *Compressor) Compress(optimal *Block, input []byte, skip int, backwardsMode, invertMode bool, delta []int) []byte {
@@ -108,6 +147,7 @@ func (c *Compressor) Compress(optimal *Block, input []byte, skip int, backwardsM
 	c.outputIndex = 0
 	c.bitMask = 0
 	c.backtrack = true
+	c.tokenStart = -1
 
 	// generate output
 	for optimal = prev.Chain; optimal != nil; prev, optimal = optimal, optimal.Chain {
@@ -118,18 +158,21 @@ func (c *Compressor) Compress(optimal *Block, input []byte, skip int, backwardsM
 
 			// copy literals length
 			c.writeInterlacedEliasGamma(length, backwardsMode, false)
+			token := Token{Type: TOKEN_LITERALS, LengthBits: string(c.gammaBits), Length: length, OutputPosition: c.inputIndex - skip}
 
 			// copy literals values
 			for i := 0; i < length; i++ {
 				c.writeByte(int(input[c.inputIndex]))
 				c.readBytes(1, delta)
 			}
+			c.trace(token)
 		} else if optimal.Offset == lastOffset {
 			// copy from last offset indicator
 			c.writeBit(0)
 
 			// copy from last offset length
 			c.writeInterlacedEliasGamma(length, backwardsMode, false)
+			c.trace(Token{Type: TOKEN_LAST_OFFSET, LengthBits: string(c.gammaBits), Offset: lastOffset, Length: length, OutputPosition: c.inputIndex - skip})
 			c.readBytes(length, delta)
 		} else {
 			// copy from new offset indicator
@@ -137,13 +180,17 @@ func (c *Compressor) Compress(optimal *Block, input []byte, skip int, backwardsM
 
 			// copy from new offset MSB
 			c.writeInterlacedEliasGamma((optimal.Offset-1)/128+1, backwardsMode, invertMode)
+			token := Token{Type: TOKEN_NEW_OFFSET, OffsetBits: string(c.gammaBits), Offset: optimal.Offset, Length: length, OutputPosition: c.inputIndex - skip}
 
 			// copy from new offset LSB
 			c.writeByte(btoi(backwardsMode)*((optimal.Offset-1)%128)<<1 + btoi(!backwardsMode)*(127-(optimal.Offset-1)%128)<<1)
+			lsbIndex := c.outputIndex - 1
 
 			// copy from new offset length
 			c.backtrack = true
 			c.writeInterlacedEliasGamma(length-1, backwardsMode, false)
+			token.OffsetLSB, token.LengthBits = int(c.output[lsbIndex]), string(c.gammaBits)
+			c.trace(token)
 			c.readBytes(length, delta)
 
 			lastOffset = optimal.Offset
@@ -153,6 +200,7 @@ func (c *Compressor) Compress(optimal *Block, input []byte, skip int, backwardsM
 	// end marker
 	c.writeBit(1)
 	c.writeInterlacedEliasGamma(256, backwardsMode, invertMode)
+	c.trace(Token{Type: TOKEN_END, OffsetBits: string(c.gammaBits), OutputPosition: c.inputIndex - skip})
 
 	// done!
 	return c.output
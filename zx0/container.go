@@ -0,0 +1,263 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+const (
+	CONTAINER_MAGIC       = "ZX0B"
+	CONTAINER_VERSION     = 1
+	CONTAINER_HEADER_SIZE = 28
+	CONTAINER_CLASSIC     = 0x01
+)
+
+// Container is a file split into blocks compressed separately, so they can
+// be compressed in parallel and decompressed on their own. Blocks may use
+// the end of the previous one as a dictionary, improving compression but
+// making each block depend on all previous ones.
+//
+// The header holds the magic "ZX0B", a version and flags byte, two reserved
+// bytes, the block size, the dictionary size, the total decompressed size
+// (64 bits) and the number of blocks, followed by the compressed size of
+// each block. All values are little endian, and the compressed blocks
+// follow in order, so the header is also an index of their positions.
+type Container struct {
+	BlockSize  int
+	Dictionary int
+	Size       int
+	Classic    bool
+	Blocks     []int
+	reader     io.ReaderAt
+	offsets    []int
+}
+
+// IndexEntry locates a block within the decompressed data and within the
+// container.
+type IndexEntry struct {
+	Start          int `json:"start"`
+	Size           int `json:"size"`
+	Offset         int `json:"offset"`
+	CompressedSize int `json:"compressed_size"`
+}
+
+// CompressContainer splits an input into blocks and compresses them at a
+// compression level with the given number of threads, each block using a
+// single one.
+func CompressContainer(input []byte, blockSize, dictionary, level, threads int, classic bool) []byte {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	count := (len(input) + blockSize - 1) / blockSize
+	blocks := make([][]byte, count)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range jobs {
+				start := block * blockSize
+				end := min(start+blockSize, len(input))
+				from := max(start-dictionary, 0)
+				optimizer := NewOptimizer()
+				optimizer.SetLevel(level)
+				optimal := optimizer.Optimize(input[from:end], start-from, MAX_OFFSET, 1, false)
+				blocks[block] = NewCompressor().Compress(optimal, input[from:end], start-from, false, !classic, []int{0})
+			}
+		}()
+	}
+	for block := 0; block < count; block++ {
+		jobs <- block
+	}
+	close(jobs)
+	wg.Wait()
+
+	header := make([]byte, CONTAINER_HEADER_SIZE, CONTAINER_HEADER_SIZE+4*count)
+	copy(header, CONTAINER_MAGIC)
+	header[4] = CONTAINER_VERSION
+	if classic {
+		header[5] |= CONTAINER_CLASSIC
+	}
+	binary.LittleEndian.PutUint32(header[8:], uint32(blockSize))
+	binary.LittleEndian.PutUint32(header[12:], uint32(dictionary))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(input)))
+	binary.LittleEndian.PutUint32(header[24:], uint32(count))
+	for _, block := range blocks {
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(block)))
+	}
+	output := header
+	for _, block := range blocks {
+		output = append(output, block...)
+	}
+	return output
+}
+
+// IsContainer reports whether data holds a valid container header, with
+// block sizes matching the length of the data.
+func IsContainer(data []byte) bool {
+	_, err := ParseContainer(data)
+	return err == nil
+}
+
+// ParseContainer reads the header of a container held in memory, checking
+// it's consistent with the data.
+func ParseContainer(data []byte) (*Container, error) {
+	return ReadContainer(bytes.NewReader(data), int64(len(data)))
+}
+
+// ReadContainer reads the header of a container of the given size, checking
+// it's consistent. Blocks are read from the reader when needed.
+func ReadContainer(reader io.ReaderAt, size int64) (*Container, error) {
+	header := make([]byte, CONTAINER_HEADER_SIZE)
+	if size < CONTAINER_HEADER_SIZE {
+		return nil, fmt.Errorf("Not a block container")
+	}
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != CONTAINER_MAGIC {
+		return nil, fmt.Errorf("Not a block container")
+	}
+	if header[4] != CONTAINER_VERSION {
+		return nil, fmt.Errorf("Unsupported block container version %d", header[4])
+	}
+	c := &Container{
+		BlockSize:  int(binary.LittleEndian.Uint32(header[8:])),
+		Dictionary: int(binary.LittleEndian.Uint32(header[12:])),
+		Size:       int(binary.LittleEndian.Uint64(header[16:])),
+		Classic:    header[5]&CONTAINER_CLASSIC != 0,
+		reader:     reader,
+	}
+	count := int(binary.LittleEndian.Uint32(header[24:]))
+	if c.BlockSize <= 0 || c.Size < 0 || count != (c.Size+c.BlockSize-1)/c.BlockSize ||
+		int64(count) > (size-CONTAINER_HEADER_SIZE)/4 {
+		return nil, fmt.Errorf("Invalid block container header")
+	}
+	sizes := make([]byte, 4*count)
+	if _, err := reader.ReadAt(sizes, CONTAINER_HEADER_SIZE); err != nil && count > 0 {
+		return nil, err
+	}
+	offset := CONTAINER_HEADER_SIZE + len(sizes)
+	for i := 0; i < count; i++ {
+		blockSize := int(binary.LittleEndian.Uint32(sizes[4*i:]))
+		c.Blocks = append(c.Blocks, blockSize)
+		c.offsets = append(c.offsets, offset)
+		offset += blockSize
+	}
+	if int64(offset) != size {
+		return nil, fmt.Errorf("Invalid block container size")
+	}
+	return c, nil
+}
+
+// Block reads the compressed data of a block.
+func (c *Container) Block(block int) ([]byte, error) {
+	data := make([]byte, c.Blocks[block])
+	if _, err := c.reader.ReadAt(data, int64(c.offsets[block])); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Index returns the position of every block, decompressed and compressed.
+func (c *Container) Index() []IndexEntry {
+	index := []IndexEntry{}
+	for block := range c.Blocks {
+		start, end := c.BlockRange(block)
+		index = append(index, IndexEntry{start, end - start, c.offsets[block], c.Blocks[block]})
+	}
+	return index
+}
+
+// Find returns the block holding a position of the decompressed data.
+func (c *Container) Find(position int) int {
+	return position / c.BlockSize
+}
+
+// BlockRange returns the range of decompressed data held by a block.
+func (c *Container) BlockRange(block int) (start, end int) {
+	start = block * c.BlockSize
+	return start, min(start+c.BlockSize, c.Size)
+}
+
+// DecompressBlock decompresses a single block, given the data preceding it
+// when the container uses a dictionary.
+func (c *Container) DecompressBlock(block int, dictionary []byte) ([]byte, error) {
+	start, end := c.BlockRange(block)
+	data, err := c.Block(block)
+	if err != nil {
+		return nil, err
+	}
+	decompressor := NewDecompressor()
+	decompressor.SetDictionary(dictionary[max(len(dictionary)-c.Dictionary, 0):])
+	output, err := decompressor.Decompress(data, false, !c.Classic)
+	if err == nil && len(output) != end-start {
+		err = fmt.Errorf("Decompression error: block %d has %d bytes instead of %d", block, len(output), end-start)
+	}
+	return output, err
+}
+
+// Decompress decompresses every block, in parallel unless they use a
+// dictionary. The output grows as blocks are decompressed, in batches of one
+// block per thread, rather than trusting the size in the header.
+func (c *Container) Decompress(threads int) ([]byte, error) {
+	switch {
+	case c.Dictionary > 0:
+		threads = 1
+	case threads <= 0:
+		threads = runtime.NumCPU()
+	}
+	output := []byte{}
+	for first := 0; first < len(c.Blocks); first += threads {
+		blocks := make([][]byte, min(threads, len(c.Blocks)-first))
+		errs := make([]error, len(blocks))
+		var wg sync.WaitGroup
+		for i := range blocks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				blocks[i], errs[i] = c.DecompressBlock(first+i, output)
+			}(i)
+		}
+		wg.Wait()
+		for i, block := range blocks {
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+			output = append(output, block...)
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"testing"
+)
+
+const TEST_BLOCK_SIZE = 1024
+
+// testContainerInput returns the corpus joined into a single input, spanning
+// several blocks.
+func testContainerInput(t testing.TB) []byte {
+	input := []byte{}
+	for _, file := range testCorpus(t) {
+		input = append(input, file.input...)
+	}
+	return input
+}
+
+func TestContainerRoundTrip(t *testing.T) {
+	input := testContainerInput(t)
+	for _, dictionary := range []int{0, 256} {
+		for _, classic := range []bool{false, true} {
+			data := CompressContainer(input, TEST_BLOCK_SIZE, dictionary, LEVEL_FASTEST, 2, classic)
+			if !IsContainer(data) {
+				t.Fatalf("dictionary %d, classic %v: not a container", dictionary, classic)
+			}
+			container, err := ParseContainer(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if container.Size != len(input) || container.Dictionary != dictionary || container.Classic != classic {
+				t.Errorf("dictionary %d, classic %v: header of %d bytes, dictionary %d, classic %v",
+					dictionary, classic, container.Size, container.Dictionary, container.Classic)
+			}
+			for _, threads := range []int{1, 3} {
+				output, err := container.Decompress(threads)
+				if err != nil || !bytes.Equal(output, input) {
+					t.Errorf("dictionary %d, classic %v, %d threads: decompression failed (%v)", dictionary, classic, threads, err)
+				}
+			}
+		}
+	}
+}
+
+func TestContainerIndex(t *testing.T) {
+	input := testContainerInput(t)
+	data := CompressContainer(input, TEST_BLOCK_SIZE, 0, LEVEL_FASTEST, 2, false)
+	container, err := ParseContainer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, offset := 0, CONTAINER_HEADER_SIZE+4*len(container.Blocks)
+	for block, entry := range container.Index() {
+		if entry.Start != start || entry.Offset != offset || entry.CompressedSize != container.Blocks[block] {
+			t.Errorf("block %d indexed at %d and %d, expected at %d and %d", block, entry.Start, entry.Offset, start, offset)
+		}
+		if container.Find(entry.Start) != block || container.Find(entry.Start+entry.Size-1) != block {
+			t.Errorf("block %d not found from its range", block)
+		}
+		compressed := data[entry.Offset : entry.Offset+entry.CompressedSize]
+		output, err := NewDecompressor().Decompress(compressed, false, true)
+		if err != nil || !bytes.Equal(output, input[entry.Start:entry.Start+entry.Size]) {
+			t.Errorf("block %d doesn't decompress to its range (%v)", block, err)
+		}
+		start += entry.Size
+		offset += entry.CompressedSize
+	}
+	if start != len(input) || offset != len(data) {
+		t.Errorf("index covers %d bytes of %d, and %d compressed bytes of %d", start, len(input), offset, len(data))
+	}
+}
+
+// testContainerHeader returns the header of a container.
+func testContainerHeader(blockSize, dictionary uint32, size uint64, blocks ...uint32) []byte {
+	header := make([]byte, CONTAINER_HEADER_SIZE)
+	copy(header, CONTAINER_MAGIC)
+	header[4] = CONTAINER_VERSION
+	binary.LittleEndian.PutUint32(header[8:], blockSize)
+	binary.LittleEndian.PutUint32(header[12:], dictionary)
+	binary.LittleEndian.PutUint64(header[16:], size)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(blocks)))
+	for _, block := range blocks {
+		header = binary.LittleEndian.AppendUint32(header, block)
+	}
+	return header
+}
+
+func TestParseMalformedContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"magic", append([]byte("ZX0X"), testContainerHeader(16, 0, 16, 1)[4:]...)},
+		{"version", func() []byte { data := testContainerHeader(16, 0, 16, 1); data[4]++; return data }()},
+		{"block size", append(testContainerHeader(0, 0, 16, 1), 0)},
+		{"block count", append(testContainerHeader(16, 0, 32, 1), 0)},
+		{"block count beyond the data", testContainerHeader(1, 0, 1<<32, 1)},
+		{"data missing", testContainerHeader(16, 0, 16, 1)},
+		{"data left", append(testContainerHeader(16, 0, 16, 1), 0, 0)},
+	}
+	for _, test := range tests {
+		if _, err := ParseContainer(test.data); err == nil {
+			t.Errorf("%s: malformed container accepted", test.name)
+		}
+	}
+
+	data := CompressContainer(testContainerInput(t), TEST_BLOCK_SIZE, 0, LEVEL_FASTEST, 2, false)
+	for size := 0; size < len(data); size += 7 {
+		if _, err := ParseContainer(data[:size]); err == nil {
+			t.Errorf("container truncated to %d bytes accepted", size)
+		}
+	}
+}
+
+func TestContainerSizeNotTrusted(t *testing.T) {
+	// a single block of a byte claiming to hold 4GB
+	data := append(testContainerHeader(1<<32-1, 0, 1<<32-1, 1), 0)
+	container, err := ParseContainer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := container.Decompress(1); err == nil {
+		t.Errorf("block decompressed to 4GB")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("%d bytes allocated decompressing a byte", allocated)
+	}
+}
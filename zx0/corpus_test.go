@@ -0,0 +1,121 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testFile is an input of the test corpus.
+type testFile struct {
+	name  string
+	input []byte
+}
+
+// testCorpus returns small inputs of different kinds: source code, a
+// Spectrum-like screen, binary data with repeated chunks, random data, runs
+// of zeros and a few tiny files. Generated inputs use fixed seeds, so every
+// run compresses the same data. Short tests, handy with the race detector,
+// compress the first 2KB of each input.
+func testCorpus(t testing.TB) []testFile {
+	sources, err := filepath.Glob("*.go")
+	if err != nil || len(sources) == 0 {
+		t.Fatalf("no source files for the corpus")
+	}
+	sort.Strings(sources)
+	text := []byte{}
+	for _, source := range sources {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text = append(text, data...)
+	}
+
+	random := rand.New(rand.NewSource(1))
+
+	// a few character patterns on a screen, with mostly repeated attributes
+	screen := make([]byte, 6912)
+	patterns := make([][8]byte, 16)
+	for i := range patterns {
+		random.Read(patterns[i][:])
+	}
+	for cell := 0; cell < 768; cell++ {
+		pattern := patterns[random.Intn(4)*random.Intn(4)]
+		for line := 0; line < 8; line++ {
+			// bitmap thirds interleave the lines of every 8 rows
+			row := cell / 32
+			screen[(row/8)*2048+line*256+(row%8)*32+cell%32] = pattern[line]
+		}
+		screen[6144+cell] = byte(0x38 + random.Intn(2)*7)
+	}
+
+	// binary data copying chunks from earlier positions, sometimes altered
+	mixed := make([]byte, 8192)
+	random.Read(mixed[:256])
+	for i := 256; i < len(mixed); {
+		length := min(1+random.Intn(24), len(mixed)-i)
+		if random.Intn(4) == 0 {
+			random.Read(mixed[i : i+length])
+		} else {
+			copy(mixed[i:i+length], mixed[i-1-random.Intn(i):])
+		}
+		i += length
+	}
+
+	noise := make([]byte, 2048)
+	random.Read(noise)
+
+	files := []testFile{
+		{"text", text[:min(len(text), 8192)]},
+		{"screen", screen},
+		{"mixed", mixed},
+		{"random", noise},
+		{"zeros", make([]byte, 1024)},
+		{"one", []byte{0x55}},
+		{"two", []byte{0x55, 0xaa}},
+		{"small", []byte("hello hello")},
+	}
+	if testing.Short() {
+		for i := range files {
+			files[i].input = files[i].input[:min(len(files[i].input), 2048)]
+		}
+	}
+	return files
+}
+
+// compress compresses an input forward in the current format.
+func compress(input []byte, level, threads int) []byte {
+	optimizer := NewOptimizer()
+	optimizer.SetLevel(level)
+	optimal := optimizer.Optimize(input, 0, MAX_OFFSET, threads, false)
+	return NewCompressor().Compress(optimal, input, 0, false, true, []int{0})
+}
@@ -28,6 +28,21 @@ package zx0
 
 import "fmt"
 
+// lengths and offsets above this can't be produced by the compressor
+const MAX_ELIAS_GAMMA = 1 << 24
+
+// Stats describes the contents of a compressed stream.
+type Stats struct {
+	CompressedSize   int `json:"compressed_size"`
+	DecompressedSize int `json:"decompressed_size"`
+	LiteralRuns      int `json:"literal_runs"`
+	LiteralBytes     int `json:"literal_bytes"`
+	RepeatMatches    int `json:"repeat_matches"`
+	NewOffsetMatches int `json:"new_offset_matches"`
+	MatchedBytes     int `json:"matched_bytes"`
+	LargestOffset    int `json:"largest_offset"`
+}
+
 type Decompressor struct {
 	lastOffset int
 	inputData  []byte
@@ -39,28 +54,57 @@ type Decompressor struct {
 	inverted   bool
 	backtrack  bool
 	lastByte   int
+	stats      Stats
+	err        error
+	dictionary []byte
+
+	tracer      Tracer
+	bitIndex    int
+	bitPosition int
+	tokenStart  int
+	gammaBits   []byte
 }
 
 func NewDecompressor() *Decompressor {
 	return &Decompressor{}
 }
 
+// SetDictionary makes the decompressor start with data preceding the
+// output, as skipped by the compressor, so matches can refer to it.
+func (d *Decompressor) SetDictionary(dictionary []byte) {
+	d.dictionary = dictionary
+}
+
 func (d *Decompressor) readByte() int {
+	if d.inputIndex >= len(d.inputData) {
+		if d.err == nil {
+			d.err = fmt.Errorf("Decompression error: truncated input")
+		}
+		return 0
+	}
 	d.lastByte = int(d.inputData[d.inputIndex])
 	d.inputIndex++
 	return d.lastByte
 }
 
+// SetTracer makes the decompressor report every token it reads.
+func (d *Decompressor) SetTracer(tracer Tracer) {
+	d.tracer = tracer
+}
+
 func (d *Decompressor) readBit() int {
 	if d.backtrack {
 		d.backtrack = false
+		d.markBit((d.inputIndex-1)*8 + 7)
 		return int(d.inputData[d.inputIndex-1] & 0x01)
 	}
 	d.bitMask >>= 1
 	if d.bitMask == 0 {
 		d.bitMask = 128
+		d.bitIndex = d.inputIndex
 		d.bitValue = d.readByte()
 	}
+	d.markBit(d.bitIndex*8 + bitNumber(d.bitMask))
 
 	if (d.bitValue & d.bitMask) != 0 {
 		return 1
@@ -69,10 +113,40 @@ func (d *Decompressor) readBit() int {
 	}
 }
 
+// markBit records the position of the last bit read, which starts a new
+// token if none is in progress.
+func (d *Decompressor) markBit(position int) {
+	d.bitPosition = position
+	if d.tokenStart < 0 {
+		d.tokenStart = position
+	}
+}
+
+// trace reports a token, starting the next one at the following bit.
+func (d *Decompressor) trace(token Token) {
+	if d.tracer != nil {
+		token.BitPosition = d.tokenStart
+		d.tracer(token)
+	}
+	d.tokenStart = -1
+}
+
+func (d *Decompressor) readGammaBit() int {
+	bit := d.readBit()
+	if d.tracer != nil {
+		d.gammaBits = append(d.gammaBits, byte('0'+bit))
+	}
+	return bit
+}
+
 func (d *Decompressor) readInterlacedEliasGamma(msb bool) int {
+	d.gammaBits = d.gammaBits[:0]
 	value := 1
-	for d.readBit() == btoi(d.backwards) {
-		value = value<<1 | d.readBit() ^ btoi(msb && d.inverted)
+	for d.err == nil && d.readGammaBit() == btoi(d.backwards) {
+		value = value<<1 | d.readGammaBit() ^ btoi(msb && d.inverted)
+		if value > MAX_ELIAS_GAMMA {
+			d.err = fmt.Errorf("Decompression error: invalid length")
+		}
 	}
 	return value
 }
@@ -82,6 +156,14 @@ func (d *Decompressor) writeByte(value int) {
 }
 
 func (d *Decompressor) copyBytes(length int) {
+	if d.lastOffset <= 0 || d.lastOffset > len(d.output) {
+		if d.err == nil {
+			d.err = fmt.Errorf("Decompression error: offset %d outside decompressed data", d.lastOffset)
+		}
+		return
+	}
+	d.stats.MatchedBytes += length
+	d.stats.LargestOffset = max(d.stats.LargestOffset, d.lastOffset)
 	for ; length > 0; length-- {
 		d.output = append(d.output, d.output[len(d.output)-d.lastOffset])
 	}
@@ -90,21 +172,34 @@ func (d *Decompressor) copyBytes(length int) {
 func (d *Decompressor) Decompress(input []byte, backwardsMode, invertMode bool) ([]byte, error) {
 	d.lastOffset = INITIAL_OFFSET
 	d.inputData = input
-	d.output = []byte{}
+	d.output = append([]byte{}, d.dictionary...)
 	d.inputIndex = 0
 	d.bitMask = 0
 	d.backwards = backwardsMode
 	d.inverted = invertMode
 	d.backtrack = false
+	d.stats = Stats{}
+	d.err = nil
+	d.tokenStart = -1
 
 	state := COPY_LITERALS
 	for state != COPY_END {
 		state = state.Process(d)
+		if d.err != nil {
+			return nil, d.err
+		}
 		if state == COPY_UNKNOWN {
 			return nil, fmt.Errorf("Decompression error: invalid state")
 		}
 	}
-	return d.output, nil
+	d.stats.CompressedSize = d.inputIndex
+	d.stats.DecompressedSize = len(d.output) - len(d.dictionary)
+	return d.output[len(d.dictionary):], nil
+}
+
+// Stats returns the statistics of the last stream decompressed.
+func (d *Decompressor) Stats() Stats {
+	return d.stats
 }
 
 type State int
@@ -121,26 +216,36 @@ func (s State) Process(d *Decompressor) State {
 	switch s {
 	case COPY_LITERALS:
 		length := d.readInterlacedEliasGamma(false)
-		for i := 0; i < length; i++ {
+		token := Token{Type: TOKEN_LITERALS, LengthBits: string(d.gammaBits), Length: length, OutputPosition: len(d.output)}
+		for i := 0; i < length && d.err == nil; i++ {
 			d.writeByte(d.readByte())
 		}
+		d.trace(token)
+		d.stats.LiteralRuns++
+		d.stats.LiteralBytes += length
 		if d.readBit() == 0 {
 			return COPY_FROM_LAST_OFFSET
 		}
 		return COPY_FROM_NEW_OFFSET
 	case COPY_FROM_LAST_OFFSET:
 		length := d.readInterlacedEliasGamma(false)
+		d.trace(Token{Type: TOKEN_LAST_OFFSET, LengthBits: string(d.gammaBits), Offset: d.lastOffset, Length: length, OutputPosition: len(d.output)})
 		d.copyBytes(length)
+		d.stats.RepeatMatches++
 		if d.readBit() == 0 {
 			return COPY_LITERALS
 		}
 		return COPY_FROM_NEW_OFFSET
 	case COPY_FROM_NEW_OFFSET:
 		msb := d.readInterlacedEliasGamma(true)
+		token := Token{Type: TOKEN_NEW_OFFSET, OffsetBits: string(d.gammaBits), OutputPosition: len(d.output)}
 		if msb == 256 {
+			token.Type = TOKEN_END
+			d.trace(token)
 			return COPY_END
 		}
-		lsb := d.readByte() >> 1
+		token.OffsetLSB = d.readByte()
+		lsb := token.OffsetLSB >> 1
 		if d.backwards {
 			d.lastOffset = (msb*128 + lsb - 127)
 		} else {
@@ -148,7 +253,10 @@ func (s State) Process(d *Decompressor) State {
 		}
 		d.backtrack = true
 		length := d.readInterlacedEliasGamma(false) + 1
+		token.LengthBits, token.Offset, token.Length = string(d.gammaBits), d.lastOffset, length
+		d.trace(token)
 		d.copyBytes(length)
+		d.stats.NewOffsetMatches++
 		if d.readBit() == 0 {
 			return COPY_LITERALS
 		}
@@ -0,0 +1,362 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	FINDER_PARALLEL      = 1024
+	FINDER_OFFSET_SIZE   = 4*4 + 8 + 4*8
+	FINDER_POSITION_SIZE = 40 + 4*8
+	FINDER_NONE          = math.MaxInt64
+)
+
+// matchFinder lets the optimizer visit only the offsets matching at each
+// position, instead of testing all of them. Matching offsets are listed by
+// following chains of earlier positions holding the same byte, while the
+// others, which can only extend a literal run since their last match, are
+// grouped by the position of that match. Literal runs starting at the same
+// position cost the same, so a tree holding the cheapest of each group finds
+// the best literal run for every range of lengths with the same Elias gamma
+// size, which is exactly the block the full scan would have chosen.
+type matchFinder struct {
+	previous []int32 // earlier position with the same byte, as a ring
+	mask     int
+	last     [256]int32
+	next     int
+	matches  []int32
+	keys     []int64 // group keys of the matching offsets, once processed
+
+	runEnd   []int32 // last position of the current match run, per offset
+	bucketOf []int32 // group holding each offset, plus one, or 0 if none
+	buckets  []bucket
+	dirty    []int32
+	spare    [][]int64
+	base     int
+	capacity int
+
+	// tree holds the cheapest key of every group, keyed by the position of
+	// their last match, relative to base, and the minimum of its children
+	tree   []int64
+	leaves int
+}
+
+// bucket groups the offsets whose last match ended at the same position.
+// Keys hold the cost of that match, less 8 bits per byte of its position,
+// in the upper bits and the offset in the lower 16, so the smallest key is
+// the cheapest literal run from there, taking the smallest offset on ties.
+// Offsets leave when they match again and are dropped from keys lazily,
+// which are only made a heap once the cheapest one leaves.
+type bucket struct {
+	keys  []int64
+	alive int
+	heap  bool
+	dirty bool
+}
+
+func newMatchFinder(size, skip, arraySize int) *matchFinder {
+	f := &matchFinder{
+		runEnd:   make([]int32, arraySize),
+		bucketOf: make([]int32, arraySize),
+		matches:  make([]int32, 0, arraySize),
+		keys:     make([]int64, arraySize),
+		buckets:  make([]bucket, size-skip+1),
+		base:     skip - 1,
+	}
+	ring := 1
+	for ring < arraySize {
+		ring *= 2
+	}
+	f.previous = make([]int32, ring)
+	f.mask = ring - 1
+	for i := range f.last {
+		f.last[i] = -1
+	}
+	for i := range f.runEnd {
+		f.runEnd[i] = -1
+	}
+	f.leaves = 1
+	for f.leaves < len(f.buckets) {
+		f.leaves *= 2
+	}
+	f.tree = make([]int64, 2*f.leaves)
+	for i := range f.tree {
+		f.tree[i] = FINDER_NONE
+	}
+	return f
+}
+
+// find lists the offsets up to maxOffset matching at an index, in
+// increasing order.
+func (f *matchFinder) find(input []byte, index, skip, maxOffset int) []int32 {
+	for ; f.next < index; f.next++ {
+		f.previous[f.next&f.mask] = f.last[input[f.next]]
+		f.last[input[f.next]] = int32(f.next)
+	}
+	f.matches = f.matches[:0]
+	if index == skip {
+		return f.matches
+	}
+	for position := int(f.last[input[index]]); position >= 0 && index-position <= maxOffset; position = int(f.previous[position&f.mask]) {
+		f.matches = append(f.matches, int32(index-position))
+	}
+	return f.matches
+}
+
+func groupKey(bits, position int, offset int32) int64 {
+	return int64(bits-8*position)<<16 | int64(offset)
+}
+
+// insert groups the offsets whose last match ended at a position, skipping
+// keys of offsets without a match.
+func (f *matchFinder) insert(position int, keys []int64) {
+	b := position - f.base
+	bkt := &f.buckets[b]
+	if n := len(f.spare); n > 0 {
+		bkt.keys, f.spare = f.spare[n-1], f.spare[:n-1]
+	}
+	capacity := cap(bkt.keys)
+	minimum := int64(FINDER_NONE)
+	for _, key := range keys {
+		if key != FINDER_NONE {
+			bkt.keys = append(bkt.keys, key)
+			f.bucketOf[key&0xFFFF] = int32(b + 1)
+			minimum = min64(minimum, key)
+		}
+	}
+	f.capacity += cap(bkt.keys) - capacity
+	bkt.alive = len(bkt.keys)
+	f.update(b, minimum)
+}
+
+// remove takes a matching offset out of its group, which is refreshed later
+// if it was the cheapest one there, or if most of its keys are gone.
+func (f *matchFinder) remove(offset int32) {
+	b := int(f.bucketOf[offset]) - 1
+	if b < 0 {
+		return
+	}
+	f.bucketOf[offset] = 0
+	bkt := &f.buckets[b]
+	bkt.alive--
+	if !bkt.dirty && (f.tree[f.leaves+b]&0xFFFF == int64(offset) || bkt.alive*4 < len(bkt.keys)) {
+		bkt.dirty = true
+		f.dirty = append(f.dirty, int32(b))
+	}
+}
+
+// refresh finds the cheapest offset left in the groups changed by remove.
+func (f *matchFinder) refresh() {
+	for _, b := range f.dirty {
+		bkt := &f.buckets[b]
+		bkt.dirty = false
+		if bkt.alive == 0 {
+			f.spare = append(f.spare, bkt.keys[:0])
+			*bkt = bucket{}
+			f.update(int(b), FINDER_NONE)
+			continue
+		}
+		alive := func(key int64) bool {
+			return f.bucketOf[key&0xFFFF] == b+1
+		}
+		if !bkt.heap || bkt.alive*4 < len(bkt.keys) {
+			keys := bkt.keys[:0]
+			for _, key := range bkt.keys {
+				if alive(key) {
+					keys = append(keys, key)
+				}
+			}
+			for i := len(keys)/2 - 1; i >= 0; i-- {
+				siftDown(keys, i)
+			}
+			bkt.keys, bkt.heap = keys, true
+		}
+		for !alive(bkt.keys[0]) {
+			last := len(bkt.keys) - 1
+			bkt.keys[0] = bkt.keys[last]
+			bkt.keys = bkt.keys[:last]
+			siftDown(bkt.keys, 0)
+		}
+		f.update(int(b), bkt.keys[0])
+	}
+	f.dirty = f.dirty[:0]
+}
+
+func siftDown(keys []int64, i int) {
+	for {
+		child := 2*i + 1
+		if child >= len(keys) {
+			return
+		}
+		if child+1 < len(keys) && keys[child+1] < keys[child] {
+			child++
+		}
+		if keys[i] <= keys[child] {
+			return
+		}
+		keys[i], keys[child] = keys[child], keys[i]
+		i = child
+	}
+}
+
+// literal finds the cheapest literal run ending at an index among the
+// grouped offsets, returning its cost and offset, or 0 if there are none.
+func (f *matchFinder) literal(index int) (int, int) {
+	bits, offset := 0, 0
+	for class := 0; index-1<<class >= f.base; class++ {
+		from := max(index-1<<(class+1)+1, f.base)
+		key := f.query(from-f.base, index-1<<class-f.base)
+		if key == FINDER_NONE {
+			continue
+		}
+		// a run of length 2^class up to 2^(class+1)-1 takes 2*class+1 bits
+		// for its length, plus 1 for the literal flag
+		keyBits := int(key>>16) + 8*index + 2*class + 2
+		if offset == 0 || keyBits < bits || keyBits == bits && int(key&0xFFFF) < offset {
+			bits, offset = keyBits, int(key&0xFFFF)
+		}
+	}
+	return bits, offset
+}
+
+func (f *matchFinder) update(b int, key int64) {
+	i := b + f.leaves
+	f.tree[i] = key
+	for i > 1 {
+		i >>= 1
+		f.tree[i] = min64(f.tree[2*i], f.tree[2*i+1])
+	}
+}
+
+// query returns the smallest key of the groups from one to another,
+// inclusive.
+func (f *matchFinder) query(from, to int) int64 {
+	key := int64(FINDER_NONE)
+	for from, to = from+f.leaves, to+f.leaves+1; from < to; from, to = from>>1, to>>1 {
+		if from&1 == 1 {
+			key = min64(key, f.tree[from])
+			from++
+		}
+		if to&1 == 1 {
+			to--
+			key = min64(key, f.tree[to])
+		}
+	}
+	return key
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// processMatches finds the optimal block ending at an index using the match
+// finder, returning it with a reference held for the caller. The blocks
+// kept per offset, and the one chosen on ties, are the same processTask
+// would have produced.
+func (o *Optimizer) processMatches(index, skip, maxOffset, threads int, input []byte) int32 {
+	f := o.finder
+	matches := f.find(input, index, skip, maxOffset)
+	maxLength := 0
+	for _, offset := range matches {
+		f.remove(offset)
+		if int(f.runEnd[offset]) == index-1 {
+			o.matchLength[offset]++
+		} else {
+			o.matchLength[offset] = 1
+		}
+		f.runEnd[offset] = int32(index)
+		maxLength = max(maxLength, o.matchLength[offset])
+	}
+	f.refresh()
+	literalBits, literalOffset := f.literal(index)
+
+	// the best length table is filled beforehand, so threads only read it
+	bestLengthSize := o.extendBestLength(index, 2, maxLength)
+
+	optimalBlock := int32(0)
+	keys := f.keys[:len(matches)]
+	if threads == 1 || len(matches) < FINDER_PARALLEL {
+		optimalBlock = o.processMatchList(o.pools[0], matches, keys, index, bestLengthSize)
+	} else {
+		blocks := make([]int32, threads)
+		taskSize := len(matches)/threads + 1
+		var wg sync.WaitGroup
+		for i := 0; i*taskSize < len(matches); i++ {
+			from, to := i*taskSize, min((i+1)*taskSize, len(matches))
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				blocks[i] = o.processMatchList(o.pools[i], matches[from:to], keys[from:to], index, bestLengthSize)
+			}(i)
+		}
+		wg.Wait()
+		for _, block := range blocks {
+			if block == 0 {
+				continue
+			}
+			if optimalBlock == 0 || o.bits(optimalBlock) > o.bits(block) {
+				o.pools[0].release(optimalBlock)
+				optimalBlock = block
+			} else {
+				o.pools[0].release(block)
+			}
+		}
+	}
+
+	if literalOffset != 0 && (optimalBlock == 0 || literalBits < o.bits(optimalBlock) ||
+		literalBits == o.bits(optimalBlock) && literalOffset < int(o.arena.node(optimalBlock).offset)) {
+		o.pools[0].assign(&optimalBlock, o.pools[0].allocate(literalBits, index, 0, o.lastMatch[literalOffset]))
+	}
+
+	f.insert(index, keys)
+	return optimalBlock
+}
+
+// processMatchList finds the optimal blocks ending at an index for a list of
+// matching offsets, returning the best of them with a reference held for the
+// caller, and the group key of each offset. Offsets starting a match run get
+// the literal run before it first.
+func (o *Optimizer) processMatchList(p *pool, offsets []int32, keys []int64, index, bestLengthSize int) int32 {
+	optimalBlock := int32(0)
+	for i, offset := range offsets {
+		if o.matchLength[offset] == 1 {
+			o.literalBefore(p, int(offset), index)
+		}
+		o.processMatch(p, int(offset), index, bestLengthSize, &optimalBlock)
+		keys[i] = FINDER_NONE
+		if o.lastMatch[offset] != 0 {
+			keys[i] = groupKey(int(o.matchBits[offset]), index, offset)
+		}
+	}
+	return optimalBlock
+}
@@ -1,27 +1,66 @@
 package zx0
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"os"
 	"runtime"
 	"sort"
 	"sync"
+	"time"
 )
 
 const (
 	INITIAL_OFFSET = 1
+	MAX_OFFSET     = 32640
+	MAX_OFFSET_ZX7 = 2176
 	MAX_SCALE      = 50
+	MIN_WINDOW     = 256
+	MIN_OFFSETS    = 128
+
+	// positions between measures of the memory used
+	MEASURE_INTERVAL = 1024
+
+	// memory taken by each offset, keeping about 16 blocks alive on typical
+	// data, and by each position, keeping one more
+	OFFSET_MEMORY   = 4 + 4 + 8 + 4 + 4 + 16*ARENA_NODE_SIZE
+	POSITION_MEMORY = 4 + 8 + ARENA_NODE_SIZE
 )
 
 type Optimizer struct {
-	lastLiteral []*Block
-	lastMatch   []*Block
-	optimal     []*Block
+	arena       *arena
+	finder      *matchFinder
+	pools       []*pool
+	lastLiteral []int32
+	lastMatch   []int32
+	optimal     []int32
 	matchLength []int
 	bestLength  []int
+
+	// bits and index of the last match at each offset, kept apart from the
+	// blocks so literal runs can be costed without visiting them
+	matchBits  []int32
+	matchIndex []int32
+	masks      [][]byte
+
+	// optimal blocks and match lengths are limited to a window of recent
+	// positions when compressing under a memory budget
+	window    int
+	mask      int
+	maxMemory int64
+	memory    int64
+	baseline  int64
+	level     int
+
+	checkpointName     string
+	checkpointInterval time.Duration
+	checkpointTime     time.Time
+	checkpointHash     [sha256.Size]byte
+	checkpointIds      []uint32
 }
 
 func NewOptimizer() *Optimizer {
-	return &Optimizer{}
+	return &Optimizer{level: LEVEL_OPTIMAL}
 }
 
 func offsetCeiling(index, offsetLimit int) int {
@@ -37,51 +76,222 @@ func eliasGammaBits(value int) int {
 	return bits
 }
 
+// SetMaxMemory limits the memory used by the optimizer, in bytes. When the
+// whole input doesn't fit, match lengths are limited to a window of recent
+// positions small enough to fit instead, at some cost in compression ratio,
+// and offsets are limited too when even the smallest window doesn't fit.
+// The limit is approximate, as the blocks kept depend on the input, and it
+// doesn't depend on the number of threads, so the output doesn't either.
+// Limits below MinMemory can't be met. A limit of 0 disables it.
+func (o *Optimizer) SetMaxMemory(bytes int64) {
+	o.maxMemory = bytes
+}
+
+// SetLevel selects the compression level, from LEVEL_FASTEST to
+// LEVEL_OPTIMAL. Levels up to 6 use greedy and lazy parsers, much faster
+// than the optimal one but compressing less, and levels 7 and 8 use the
+// optimal parser with smaller offsets. Each level keeps the output of the
+// level below when smaller, so higher levels never compress worse. All of
+// them produce valid streams. LEVEL_QUICK selects the quick compression of
+// the original compressor instead, producing exactly the same output.
+func (o *Optimizer) SetLevel(level int) {
+	o.level = min(max(level, LEVEL_QUICK), LEVEL_OPTIMAL)
+}
+
+// PeakMemory returns the largest growth of the heap measured during the
+// last compression, in bytes. It's measured for the whole program, so it
+// includes any other compression running at the same time.
+func (o *Optimizer) PeakMemory() int64 {
+	return o.memory
+}
+
+// MinMemory returns the smallest memory budget the optimizer can keep to,
+// limiting offsets to MIN_OFFSETS and match lengths to MIN_WINDOW positions,
+// with each thread also holding a chunk of blocks.
+func MinMemory(threads int) int64 {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return (MIN_OFFSETS+1)*OFFSET_MEMORY + MIN_WINDOW*POSITION_MEMORY + int64(threads)*ARENA_CHUNK_BYTES
+}
+
+// measure keeps the largest growth of the heap seen since the compression
+// started.
+func (o *Optimizer) measure() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	o.memory = max64(o.memory, int64(stats.HeapAlloc)-o.baseline)
+}
+
+// Window returns the match length limit used by the last compression, which
+// is the whole input unless limited by the memory budget.
+func (o *Optimizer) Window() int {
+	return o.window
+}
+
+// chooseWindow fits the optimizer in the memory budget, returning the number
+// of offsets kept and whether there is room for the match finder too. When
+// the whole input doesn't fit, the optimal blocks kept are limited to a power
+// of two number of positions, and when even MIN_WINDOW positions don't fit
+// with every offset, offsets are limited too, down to MIN_OFFSETS.
+func (o *Optimizer) chooseWindow(size, arraySize int) (int, bool) {
+	o.window, o.mask = size, -1
+	memory := int64(arraySize)*OFFSET_MEMORY + int64(size)*POSITION_MEMORY
+	finder := int64(arraySize)*FINDER_OFFSET_SIZE + int64(size)*FINDER_POSITION_SIZE
+	if o.maxMemory <= 0 || memory+finder <= o.maxMemory {
+		return arraySize, true
+	}
+	if memory <= o.maxMemory {
+		return arraySize, false
+	}
+	offsets := (o.maxMemory - MIN_WINDOW*POSITION_MEMORY) / OFFSET_MEMORY
+	arraySize = min(arraySize, int(max64(offsets, MIN_OFFSETS+1)))
+	window := MIN_WINDOW
+	for window < size && int64(arraySize)*OFFSET_MEMORY+int64(window)*2*POSITION_MEMORY <= o.maxMemory {
+		window *= 2
+	}
+	if window < size {
+		o.window, o.mask = window-1, window-1
+	}
+	return arraySize, false
+}
+
 type Job struct {
-	initialOffset, finalOffset, index, skip int
+	initialOffset, finalOffset, index, skip, bestLengthSize int
 }
 
 type JobResult struct {
-	Block         *Block
+	Block         int32
 	initialOffset int
+	maxLength     int
 }
 
 func (o *Optimizer) Optimize(input []byte, skip, offsetLimit, threads int, verbose bool) *Block {
-	arraySize := offsetCeiling(len(input)-1, offsetLimit) + 1
-	o.lastLiteral = make([]*Block, arraySize)
-	o.lastMatch = make([]*Block, arraySize)
-	o.optimal = make([]*Block, len(input))
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	o.memory, o.baseline = 0, int64(stats.HeapAlloc)
+	if levels[o.level].parser != PARSER_OPTIMAL {
+		o.window = len(input)
+		return o.parseLevel(input, skip, offsetLimit, o.level)
+	}
+	var heuristic *Block
+	if o.level != LEVEL_QUICK {
+		heuristic = o.parseLevel(input, skip, offsetLimit, LEVEL_HEURISTIC)
+	}
+	if o.maxMemory > 0 {
+		// free the parses discarded before filling the budget
+		runtime.GC()
+	}
+	if window := levels[o.level].window; window > 0 {
+		offsetLimit = min(offsetLimit, window)
+	}
+
+	arraySize, useFinder := o.chooseWindow(len(input), offsetCeiling(len(input)-1, offsetLimit)+1)
+	offsetsLimited := arraySize-1 < offsetCeiling(len(input)-1, offsetLimit)
+	offsetLimit = min(offsetLimit, arraySize-1)
+	o.finder = nil
+	if useFinder {
+		o.finder = newMatchFinder(len(input), skip, arraySize)
+	}
+	o.lastLiteral = make([]int32, arraySize)
+	o.lastMatch = make([]int32, arraySize)
+	o.optimal = make([]int32, min(len(input), o.window+1))
 	o.matchLength = make([]int, arraySize)
-	o.bestLength = make([]int, len(input))
+	o.matchBits = make([]int32, arraySize)
+	o.matchIndex = make([]int32, arraySize)
+	o.bestLength = make([]int, min(len(input), o.window+1))
 	if len(o.bestLength) > 2 {
 		o.bestLength[2] = 2
 	}
 
-	o.lastMatch[INITIAL_OFFSET] = &Block{-1, skip - 1, INITIAL_OFFSET, nil}
+	// every position creates at most two blocks per offset, although most
+	// of them are released and reused long before the end
+	capacity := 2*(len(input)-skip)*arraySize + threads*ARENA_CHUNK_SIZE
+	o.newArena(capacity, threads)
+	o.masks = nil
+	if o.finder == nil {
+		o.masks = make([][]byte, threads)
+		for i := range o.masks {
+			o.masks[i] = make([]byte, arraySize)
+		}
+	}
 
-	if threads <= 0 {
-		threads = runtime.NumCPU()
+	start := skip
+	if o.checkpointName != "" {
+		index, err := o.resume(input, skip, arraySize)
+		if err == nil {
+			start = index + 1
+			if verbose {
+				fmt.Fprintf(os.Stderr, "Resuming from checkpoint at %d bytes\n", start-skip)
+			}
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: Ignoring checkpoint file %s (%v)\n", o.checkpointName, err)
+			o.newArena(capacity, threads)
+		}
+	}
+	if start == skip {
+		o.setLastMatch(o.pools[0], INITIAL_OFFSET, o.pools[0].allocate(-1, skip-1, INITIAL_OFFSET, 0))
+		if o.finder != nil {
+			o.finder.insert(skip-1, []int64{groupKey(-1, skip-1, INITIAL_OFFSET)})
+		}
 	}
-	fmt.Printf("Using: %d thread(s)\n", threads)
 
 	dots := 2
 	if verbose {
-		fmt.Print("[")
+		fmt.Fprintf(os.Stderr, "Using: %d thread(s)\n", threads)
+		if o.window < len(input) {
+			fmt.Fprintf(os.Stderr, "Memory budget: matches limited to %d bytes\n", o.window)
+		}
+		if offsetsLimited {
+			fmt.Fprintf(os.Stderr, "Memory budget: offsets limited to %d bytes\n", offsetLimit)
+		}
+		fmt.Fprint(os.Stderr, "[")
 	}
 
-	if threads == 1 {
-		for index := skip; index < len(input); index++ {
+	if o.finder != nil {
+		for index := start; index < len(input); index++ {
+			maxOffset := offsetCeiling(index, offsetLimit)
+			o.forget(index)
+			o.optimal[index] = o.processMatches(index, skip, maxOffset, threads, input)
+			o.checkpoint(input, skip, arraySize, index)
+			if index%MEASURE_INTERVAL == 0 {
+				o.measure()
+			}
+			if verbose && index*MAX_SCALE/len(input) > dots {
+				fmt.Fprint(os.Stderr, ".")
+				dots++
+			}
+		}
+	} else if threads == 1 {
+		for index := start; index < len(input); index++ {
 			maxOffset := offsetCeiling(index, offsetLimit)
-			o.optimal[index] = o.processTask(1, maxOffset, index, skip, input)
+			o.forget(index)
+			o.optimal[index&o.mask], _ = o.processTask(o.pools[0], o.masks[0], 2, 1, maxOffset, index, skip, input)
+			o.checkpoint(input, skip, arraySize, index)
+			if index%MEASURE_INTERVAL == 0 {
+				o.measure()
+			}
 			if verbose && index*MAX_SCALE/len(input) > dots {
-				fmt.Print(".")
+				fmt.Fprint(os.Stderr, ".")
 				dots++
 			}
 		}
 	} else {
-		for index := skip; index < len(input); index++ {
+		// threads only read the best length table, filled beforehand up to
+		// the longest match possible, one more than at the previous index
+		maxLength := 0
+		for _, length := range o.matchLength {
+			maxLength = max(maxLength, length)
+		}
+		for index := start; index < len(input); index++ {
 			maxOffset := offsetCeiling(index, offsetLimit)
 			taskSize := maxOffset/threads + 1
+			o.forget(index)
+			bestLengthSize := o.extendBestLength(index, 2, min(maxLength+1, o.window))
 
 			inputJobsChan := make(chan *Job, threads)
 			outputTaskChan := make(chan *JobResult, threads)
@@ -89,41 +299,27 @@ func (o *Optimizer) Optimize(input []byte, skip, offsetLimit, threads int, verbo
 			var wgSend sync.WaitGroup
 			for i := 0; i < threads; i++ {
 				wgSend.Add(1)
-				go worker(outputTaskChan, inputJobsChan, &wgSend, o, input)
+				go worker(outputTaskChan, inputJobsChan, &wgSend, o, o.pools[i], o.masks[i], input)
 			}
 
 			var wgRecv sync.WaitGroup
 			wgRecv.Add(1)
+			results := []*JobResult{}
 			go func(index int) {
 				defer wgRecv.Done()
 				// Collect results out of order
-				results := []*JobResult{}
 				for jobResult := range outputTaskChan {
-					if jobResult.Block != nil {
-						results = append(results, jobResult)
-						if verbose && index*MAX_SCALE/len(input) > dots {
-							fmt.Print(".")
-							dots++
-						}
-					}
-				}
-
-				// Sort results by initialOffset
-				sort.Slice(results, func(i, j int) bool {
-					return results[i].initialOffset < results[j].initialOffset
-				})
-
-				// Find optimal block
-				for _, result := range results {
-					if o.optimal[index] == nil || o.optimal[index].Bits > result.Block.Bits {
-						o.optimal[index] = result.Block
+					results = append(results, jobResult)
+					if verbose && index*MAX_SCALE/len(input) > dots {
+						fmt.Fprint(os.Stderr, ".")
+						dots++
 					}
 				}
 			}(index)
 
 			for initialOffset := 1; initialOffset <= maxOffset; initialOffset += taskSize {
 				finalOffset := min(initialOffset+taskSize-1, maxOffset)
-				inputJobsChan <- &Job{initialOffset, finalOffset, index, skip}
+				inputJobsChan <- &Job{initialOffset, finalOffset, index, skip, bestLengthSize}
 			}
 
 			close(inputJobsChan)
@@ -131,78 +327,245 @@ func (o *Optimizer) Optimize(input []byte, skip, offsetLimit, threads int, verbo
 
 			close(outputTaskChan)
 			wgRecv.Wait()
+
+			// Sort results by initialOffset, so ties are broken by the smallest
+			// offset, as with a single thread
+			sort.Slice(results, func(i, j int) bool {
+				return results[i].initialOffset < results[j].initialOffset
+			})
+
+			// Find optimal block, dropping the references held by the others
+			maxLength = 0
+			for _, result := range results {
+				maxLength = max(maxLength, result.maxLength)
+				if result.Block == 0 {
+					continue
+				}
+				if o.optimal[index&o.mask] == 0 || o.bits(o.optimal[index&o.mask]) > o.bits(result.Block) {
+					o.pools[0].release(o.optimal[index&o.mask])
+					o.optimal[index&o.mask] = result.Block
+				} else {
+					o.pools[0].release(result.Block)
+				}
+			}
+			o.checkpoint(input, skip, arraySize, index)
+			if index%MEASURE_INTERVAL == 0 {
+				o.measure()
+			}
 		}
 
 	}
 
 	if verbose {
-		fmt.Println("]")
+		fmt.Fprintln(os.Stderr, "]")
 	}
+	o.removeCheckpoint()
+
+	optimal := o.arena.chain(o.optimal[(len(input)-1)&o.mask])
+	o.measure()
 
-	return o.optimal[len(input)-1]
+	// the heuristic parsers can only do better when offsets or match lengths
+	// are limited, so unlimited optimal output is never replaced
+	if heuristic != nil && heuristic.Bits < optimal.Bits {
+		return heuristic
+	}
+	return optimal
+}
+
+// parseLevel runs the greedy or lazy parsers of a level and every level
+// below, keeping the smallest parse, so that a higher level never compresses
+// worse than a lower one. Ties are won by the higher level.
+func (o *Optimizer) parseLevel(input []byte, skip, offsetLimit, level int) *Block {
+	p := newParser(input, offsetLimit)
+	var optimal *Block
+	for current := LEVEL_FASTEST; current <= level; current++ {
+		settings := levels[current]
+		maxOffset := offsetLimit
+		if settings.window > 0 {
+			maxOffset = min(offsetLimit, settings.window)
+		}
+		p.reset(settings.depth, maxOffset)
+		if block := p.parse(skip, settings.parser == PARSER_LAZY); optimal == nil || block.Bits <= optimal.Bits {
+			optimal = block
+		}
+	}
+	o.measure()
+	return optimal
+}
+
+// newArena creates the arena holding the blocks, with a pool for each
+// thread.
+func (o *Optimizer) newArena(capacity, threads int) {
+	o.arena = newArena(capacity)
+	o.pools = make([]*pool, threads)
+	for i := range o.pools {
+		o.pools[i] = newPool(o.arena)
+	}
 }
 
-func worker(outputTaskChan chan *JobResult, inputJobsChan chan *Job, wgSend *sync.WaitGroup, o *Optimizer, input []byte) {
+// forget releases the optimal block of the position leaving the window, to
+// make room for a new one.
+func (o *Optimizer) forget(index int) {
+	o.pools[0].release(o.optimal[index&o.mask])
+	o.optimal[index&o.mask] = 0
+}
+
+func worker(outputTaskChan chan *JobResult, inputJobsChan chan *Job, wgSend *sync.WaitGroup, o *Optimizer, p *pool, mask []byte, input []byte) {
 	defer wgSend.Done()
 	for inputJob := range inputJobsChan {
+		block, maxLength := o.processTask(p, mask, inputJob.bestLengthSize, inputJob.initialOffset, inputJob.finalOffset, inputJob.index, inputJob.skip, input)
 		outputTaskChan <- &JobResult{
-			Block:         o.processTask(inputJob.initialOffset, inputJob.finalOffset, inputJob.index, inputJob.skip, input),
+			Block:         block,
 			initialOffset: inputJob.initialOffset,
+			maxLength:     maxLength,
 		}
 	}
 }
 
-func (o *Optimizer) processTask(initialOffset, finalOffset, index, skip int, input []byte) *Block {
-	bestLengthSize := 2
-	var optimalBlock *Block
-	for offset := initialOffset; offset <= finalOffset; offset++ {
-		if index != skip && index >= offset && input[index] == input[index-offset] {
-			if o.lastLiteral[offset] != nil {
-				length := index - o.lastLiteral[offset].Index
-				bits := o.lastLiteral[offset].Bits + 1 + eliasGammaBits(length)
-				o.lastMatch[offset] = &Block{bits, index, offset, o.lastLiteral[offset]}
-				if optimalBlock == nil || optimalBlock.Bits > bits {
-					optimalBlock = o.lastMatch[offset]
-				}
+func (o *Optimizer) bits(handle int32) int {
+	return int(o.arena.node(handle).bits)
+}
+
+// processTask finds the optimal blocks ending at an index for a range of
+// offsets, returning the best of them with a reference held for the caller,
+// and the longest match length among them. The best length table must be
+// filled up to bestLengthSize when other threads use it too.
+// Matching offsets are found first, comparing the current byte with all
+// earlier ones in the range at once. The others can only extend a literal
+// run since their last match, so only the cheapest of them gets a block.
+func (o *Optimizer) processTask(p *pool, mask []byte, bestLengthSize, initialOffset, finalOffset, index, skip int, input []byte) (int32, int) {
+	// mask[limit-offset] tells whether an offset up to limit matches
+	limit := initialOffset - 1
+	if index != skip {
+		limit = min(finalOffset, index)
+		if limit >= initialOffset {
+			equalMask(mask, input[index-limit:index-initialOffset+1], input[index])
+		}
+	}
+
+	optimalBlock := int32(0)
+	maxLength := 0
+	for offset := initialOffset; offset <= limit; offset++ {
+		if mask[limit-offset] != 0 {
+			if o.matchLength[offset] == 0 {
+				o.literalBefore(p, offset, index)
 			}
-			if o.matchLength[offset]++; o.matchLength[offset] > 1 {
-				if bestLengthSize < o.matchLength[offset] {
-					bits := o.optimal[index-o.bestLength[bestLengthSize]].Bits + eliasGammaBits(o.bestLength[bestLengthSize]-1)
-					for {
-						bestLengthSize++
-						bits2 := o.optimal[index-bestLengthSize].Bits + eliasGammaBits(bestLengthSize-1)
-						if bits2 <= bits {
-							o.bestLength[bestLengthSize] = bestLengthSize
-							bits = bits2
-						} else {
-							o.bestLength[bestLengthSize] = o.bestLength[bestLengthSize-1]
-						}
-						if !(bestLengthSize < o.matchLength[offset]) {
-							break
-						}
-					}
-				}
-				length := o.bestLength[o.matchLength[offset]]
-				bits := o.optimal[index-length].Bits + 8 + eliasGammaBits((offset-1)/128+1) + eliasGammaBits(length-1)
-				if o.lastMatch[offset] == nil || o.lastMatch[offset].Index != index || o.lastMatch[offset].Bits > bits {
-					o.lastMatch[offset] = &Block{bits, index, offset, o.optimal[index-length]}
-					if optimalBlock == nil || optimalBlock.Bits > bits {
-						optimalBlock = o.lastMatch[offset]
-					}
-				}
+			o.matchLength[offset] = min(o.matchLength[offset]+1, o.window)
+			maxLength = max(maxLength, o.matchLength[offset])
+			bestLengthSize = o.processMatch(p, offset, index, bestLengthSize, &optimalBlock)
+		}
+	}
+
+	bits, offset := o.cheapestLiteral(mask, initialOffset, finalOffset, limit, index)
+	if offset != 0 && (optimalBlock == 0 || bits < o.bits(optimalBlock) ||
+		bits == o.bits(optimalBlock) && offset < int(o.arena.node(optimalBlock).offset)) {
+		p.assign(&optimalBlock, p.allocate(bits, index, 0, o.lastMatch[offset]))
+	}
+
+	return optimalBlock, maxLength
+}
+
+// cheapestLiteral finds the cheapest literal run ending at an index among
+// the offsets of a range not matching there, from the bits and index of
+// their last match, returning its cost and offset, or 0 if there are none.
+// Match lengths of these offsets are reset on the way.
+func (o *Optimizer) cheapestLiteral(mask []byte, initialOffset, finalOffset, limit, index int) (int, int) {
+	bits, offset := 0, 0
+	lastMatch := o.lastMatch[:finalOffset+1]
+	matchBits := o.matchBits[:finalOffset+1]
+	matchIndex := o.matchIndex[:finalOffset+1]
+	matchLength := o.matchLength[:finalOffset+1]
+	for i := initialOffset; i <= finalOffset; i++ {
+		if i <= limit && mask[limit-i] != 0 {
+			continue
+		}
+		matchLength[i] = 0
+		if lastMatch[i] != 0 {
+			length := index - int(matchIndex[i])
+			literalBits := int(matchBits[i]) + 1 + eliasGammaBits(length) + length*8
+			if offset == 0 || literalBits < bits {
+				bits, offset = literalBits, i
 			}
-		} else {
-			o.matchLength[offset] = 0
-			if o.lastMatch[offset] != nil {
-				length := index - o.lastMatch[offset].Index
-				bits := o.lastMatch[offset].Bits + 1 + eliasGammaBits(length) + length*8
-				o.lastLiteral[offset] = &Block{bits, index, 0, o.lastMatch[offset]}
-				if optimalBlock == nil || optimalBlock.Bits > bits {
-					optimalBlock = o.lastLiteral[offset]
-				}
+		}
+	}
+	return bits, offset
+}
+
+// literalBefore creates the literal run block ending just before a match
+// run starting at an index, which matches at the same offset extend.
+func (o *Optimizer) literalBefore(p *pool, offset, index int) {
+	if o.lastMatch[offset] != 0 {
+		length := index - 1 - int(o.matchIndex[offset])
+		bits := int(o.matchBits[offset]) + 1 + eliasGammaBits(length) + length*8
+		p.assign(&o.lastLiteral[offset], p.allocate(bits, index-1, 0, o.lastMatch[offset]))
+	}
+}
+
+// setLastMatch makes a block the last match at an offset.
+func (o *Optimizer) setLastMatch(p *pool, offset int, handle int32) {
+	n := o.arena.node(handle)
+	o.matchBits[offset], o.matchIndex[offset] = n.bits, n.index
+	p.assign(&o.lastMatch[offset], handle)
+}
+
+// processMatch finds the blocks ending at an index with a match at an
+// offset, given its match length, updating the best block found so far. It
+// returns the number of match lengths known to the best length table.
+func (o *Optimizer) processMatch(p *pool, offset, index, bestLengthSize int, optimalBlock *int32) int {
+	if o.lastLiteral[offset] != 0 {
+		lastLiteral := o.arena.node(o.lastLiteral[offset])
+		length := index - int(lastLiteral.index)
+		bits := int(lastLiteral.bits) + 1 + eliasGammaBits(length)
+		o.setLastMatch(p, offset, p.allocate(bits, index, offset, o.lastLiteral[offset]))
+		if *optimalBlock == 0 || o.bits(*optimalBlock) > bits {
+			p.assign(optimalBlock, o.lastMatch[offset])
+		}
+	}
+	if o.matchLength[offset] > 1 {
+		bestLengthSize = o.extendBestLength(index, bestLengthSize, o.matchLength[offset])
+		length := o.bestLength[o.matchLength[offset]]
+		bits := o.bits(o.optimal[(index-length)&o.mask]) + 8 + eliasGammaBits((offset-1)/128+1) + eliasGammaBits(length-1)
+		if o.lastMatch[offset] == 0 || int(o.matchIndex[offset]) != index || int(o.matchBits[offset]) > bits {
+			o.setLastMatch(p, offset, p.allocate(bits, index, offset, o.optimal[(index-length)&o.mask]))
+			if *optimalBlock == 0 || o.bits(*optimalBlock) > bits {
+				p.assign(optimalBlock, o.lastMatch[offset])
+			}
+		}
+	}
+	return bestLengthSize
+}
+
+// extendBestLength fills the best length table for an index up to a match
+// length, returning the number of match lengths it now holds.
+func (o *Optimizer) extendBestLength(index, bestLengthSize, matchLength int) int {
+	if bestLengthSize < matchLength {
+		bits := o.bits(o.optimal[(index-o.bestLength[bestLengthSize])&o.mask]) + eliasGammaBits(o.bestLength[bestLengthSize]-1)
+		for {
+			bestLengthSize++
+			bits2 := o.bits(o.optimal[(index-bestLengthSize)&o.mask]) + eliasGammaBits(bestLengthSize-1)
+			if bits2 <= bits {
+				o.bestLength[bestLengthSize] = bestLengthSize
+				bits = bits2
+			} else {
+				o.bestLength[bestLengthSize] = o.bestLength[bestLengthSize-1]
+			}
+			if !(bestLengthSize < matchLength) {
+				break
 			}
 		}
 	}
+	return bestLengthSize
+}
 
-	return optimalBlock
+// equalMask sets each byte of dst to 0xFF where the byte of src at the same
+// position equals c, or 0 otherwise. dst must be at least as long as src.
+func equalMask(dst, src []byte, c byte) {
+	dst = dst[:len(src)]
+	for i, b := range src {
+		if b == c {
+			dst[i] = 0xFF
+		} else {
+			dst[i] = 0
+		}
+	}
 }
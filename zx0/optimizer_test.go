@@ -0,0 +1,150 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// memory budgets exercising each path of the optimal parser: the match
+// finder, scanning every offset, and scanning with limited match lengths
+var testBudgets = []struct {
+	name   string
+	budget func(size int) int64
+}{
+	{"finder", func(size int) int64 { return 0 }},
+	{"scan", func(size int) int64 { return int64(size) * (OFFSET_MEMORY + POSITION_MEMORY) }},
+	{"window", func(size int) int64 { return int64(size)*OFFSET_MEMORY + 2*MIN_WINDOW*POSITION_MEMORY }},
+}
+
+func TestOutputIndependentOfThreads(t *testing.T) {
+	threadCounts := []int{1, 2, 4, runtime.NumCPU()}
+	for _, file := range testCorpus(t) {
+		// slow under the race detector, so inputs are kept short
+		input := file.input[:min(len(file.input), 1024)]
+		for _, budget := range testBudgets {
+			var reference []byte
+			for _, threads := range threadCounts {
+				optimizer := NewOptimizer()
+				optimizer.SetMaxMemory(budget.budget(len(input)))
+				optimal := optimizer.Optimize(input, 0, MAX_OFFSET, threads, false)
+				output := NewCompressor().Compress(optimal, input, 0, false, true, []int{0})
+				if len(input) > 2*MIN_WINDOW && ((optimizer.finder != nil) != (budget.name == "finder") ||
+					(optimizer.Window() < len(input)) != (budget.name == "window")) {
+					t.Fatalf("%s: %s budget not used, window %d", file.name, budget.name, optimizer.Window())
+				}
+				if reference == nil {
+					reference = output
+				} else if !bytes.Equal(output, reference) {
+					t.Errorf("%s, %s: output with %d threads differs from 1 thread", file.name, budget.name, threads)
+				}
+			}
+		}
+	}
+}
+
+func TestRoundTripEveryLevel(t *testing.T) {
+	for _, file := range testCorpus(t) {
+		for level := LEVEL_QUICK; level <= LEVEL_OPTIMAL; level++ {
+			for _, format := range []struct {
+				name      string
+				backwards bool
+				classic   bool
+			}{{"current", false, false}, {"classic", false, true}, {"backwards", true, false}} {
+				t.Run(fmt.Sprintf("%s/%d/%s", file.name, level, format.name), func(t *testing.T) {
+					if level != LEVEL_FASTEST && format.name != "current" && len(file.input) > 16 {
+						t.Skip("formats only differ in the compressor, checked with level 1")
+					}
+					checkRoundTrip(t, file.input, level, format.backwards, format.classic)
+				})
+			}
+		}
+	}
+}
+
+// checkRoundTrip compresses an input and checks that it decompresses back
+// to the original.
+func checkRoundTrip(t *testing.T, original []byte, level int, backwards, classic bool) {
+	input := append([]byte{}, original...)
+	if backwards {
+		reverse(input)
+	}
+	optimizer := NewOptimizer()
+	optimizer.SetLevel(level)
+	optimal := optimizer.Optimize(input, 0, MAX_OFFSET, 1, false)
+	compressed := NewCompressor().Compress(optimal, input, 0, backwards, !classic && !backwards, []int{0})
+	if backwards {
+		reverse(compressed)
+		reverse(input)
+	}
+
+	data := append([]byte{}, compressed...)
+	if backwards {
+		reverse(data)
+	}
+	output, err := NewDecompressor().Decompress(data, backwards, !classic && !backwards)
+	if err != nil {
+		t.Fatalf("decompressing %d bytes: %v", len(compressed), err)
+	}
+	if backwards {
+		reverse(output)
+	}
+	if !bytes.Equal(output, original) {
+		t.Fatalf("%d bytes decompressed to %d different bytes", len(original), len(output))
+	}
+}
+
+func reverse(data []byte) {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+}
+
+// BenchmarkOptimize compares the optimal parser finding matching offsets
+// with the match finder and scanning every offset, reporting the blocks
+// allocated too. Memory profiles can be written with "-memprofile".
+func BenchmarkOptimize(b *testing.B) {
+	for _, file := range testCorpus(b) {
+		if len(file.input) < 2048 {
+			continue
+		}
+		for _, budget := range testBudgets[:2] {
+			b.Run(file.name+"/"+budget.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(file.input)))
+				for i := 0; i < b.N; i++ {
+					optimizer := NewOptimizer()
+					optimizer.SetMaxMemory(budget.budget(len(file.input)))
+					optimizer.Optimize(file.input, 0, MAX_OFFSET, 1, false)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package zx0
+
+const (
+	LEVEL_FASTEST = 1
+	LEVEL_OPTIMAL = 9
+
+	// highest level using the greedy and lazy parsers, also tried by the
+	// optimal levels
+	LEVEL_HEURISTIC = 6
+
+	// the optimal parser limited to the offsets of ZX7, outside the graded
+	// levels, as the quick mode of the original compressor
+	LEVEL_QUICK = 0
+
+	PARSER_GREEDY  = 0
+	PARSER_LAZY    = 1
+	PARSER_OPTIMAL = 2
+
+	PARSER_HASH_SIZE = 1 << 16
+)
+
+// levelSettings selects the parser used by a compression level, how many
+// earlier positions the greedy and lazy parsers try at each position, and
+// the largest offset used, or 0 for the offset limit given.
+type levelSettings struct {
+	parser int
+	depth  int
+	window int
+}
+
+var levels = [LEVEL_OPTIMAL + 1]levelSettings{
+	0: {PARSER_OPTIMAL, 0, MAX_OFFSET_ZX7},
+	1: {PARSER_GREEDY, 4, 2176},
+	2: {PARSER_GREEDY, 16, 8192},
+	3: {PARSER_GREEDY, 64, 0},
+	4: {PARSER_LAZY, 64, 0},
+	5: {PARSER_LAZY, 256, 0},
+	6: {PARSER_LAZY, 1024, 0},
+	7: {PARSER_OPTIMAL, 0, 4096},
+	8: {PARSER_OPTIMAL, 0, 16384},
+	9: {PARSER_OPTIMAL, 0, 0},
+}
+
+// parser finds matches for the greedy and lazy parsers, following chains of
+// earlier positions starting with the same two bytes, nearest first.
+type parser struct {
+	input      []byte
+	head       []int32
+	previous   []int32
+	mask       int
+	next       int
+	depth      int
+	maxOffset  int
+	lastOffset int
+}
+
+// newParser creates a parser for offsets up to offsetLimit, to be reset
+// before each parse.
+func newParser(input []byte, offsetLimit int) *parser {
+	ring := 1
+	for ring <= offsetLimit {
+		ring *= 2
+	}
+	return &parser{
+		input:    input,
+		head:     make([]int32, PARSER_HASH_SIZE),
+		previous: make([]int32, ring),
+		mask:     ring - 1,
+	}
+}
+
+// reset empties the chains, so the input can be parsed again trying other
+// settings. Stale links are never followed, as every position is linked
+// again before a chain reaches it.
+func (p *parser) reset(depth, maxOffset int) {
+	for i := range p.head {
+		p.head[i] = -1
+	}
+	p.next, p.depth, p.maxOffset, p.lastOffset = 0, depth, maxOffset, INITIAL_OFFSET
+}
+
+// insert adds the positions before an index to the chains.
+func (p *parser) insert(index int) {
+	for ; p.next < index && p.next+1 < len(p.input); p.next++ {
+		key := int(p.input[p.next])<<8 | int(p.input[p.next+1])
+		p.previous[p.next&p.mask] = p.head[key]
+		p.head[key] = int32(p.next)
+	}
+}
+
+// matchLength returns the number of bytes matching at an index with an
+// offset.
+func (p *parser) matchLength(index, offset int) int {
+	length := 0
+	for index+length < len(p.input) && p.input[index+length] == p.input[index+length-offset] {
+		length++
+	}
+	return length
+}
+
+// find returns the best match at an index and the bits it saves over
+// literals, or 0 if none saves any. Repeating the last offset is only
+// possible after literals, and a new match can't use it.
+func (p *parser) find(index int, afterLiterals bool) (length, offset, gain int) {
+	if afterLiterals {
+		if length = p.matchLength(index, p.lastOffset); length > 0 {
+			offset, gain = p.lastOffset, length*8-1-eliasGammaBits(length)
+		}
+	}
+	if index+1 >= len(p.input) {
+		return length, offset, gain
+	}
+	p.insert(index)
+	position := int(p.head[int(p.input[index])<<8|int(p.input[index+1])])
+	for depth := 0; depth < p.depth && position >= 0 && index-position <= p.maxOffset; depth++ {
+		candidate := index - position
+		if candidate != p.lastOffset {
+			candidateLength := p.matchLength(index, candidate)
+			candidateGain := candidateLength*8 - 8 - eliasGammaBits((candidate-1)/128+1) - eliasGammaBits(candidateLength-1)
+			if candidateGain > gain {
+				length, offset, gain = candidateLength, candidate, candidateGain
+			}
+		}
+		position = int(p.previous[position&p.mask])
+	}
+	return length, offset, gain
+}
+
+// parse builds a chain of blocks for an input taking, at each position, the
+// match saving most bits over literals, if any. The lazy parser first
+// checks whether a literal followed by a match at the next position saves
+// more, by at least the 8 bits of that literal, as both matches usually
+// overlap. Costs are computed exactly as the optimal parser does, so the chain
+// can be given to the compressor.
+func (p *parser) parse(skip int, lazy bool) *Block {
+	optimal := &Block{-1, skip - 1, INITIAL_OFFSET, nil}
+	literals := skip
+	for index := skip; index < len(p.input); {
+		// the first block is always a literal
+		if index == skip {
+			index++
+			continue
+		}
+		length, offset, gain := p.find(index, index > literals)
+		if gain > 0 && lazy && index+1 < len(p.input) {
+			if _, _, nextGain := p.find(index+1, true); nextGain > gain+8 {
+				length, gain = 0, 0
+			}
+		}
+		if gain <= 0 {
+			index++
+			continue
+		}
+		bits := optimal.Bits
+		if index > literals {
+			bits += 1 + eliasGammaBits(index-literals) + (index-literals)*8
+			optimal = &Block{bits, index - 1, 0, optimal}
+		}
+		if offset == p.lastOffset {
+			bits += 1 + eliasGammaBits(length)
+		} else {
+			bits += 8 + eliasGammaBits((offset-1)/128+1) + eliasGammaBits(length-1)
+		}
+		index += length
+		optimal = &Block{bits, index - 1, offset, optimal}
+		p.lastOffset, literals = offset, index
+	}
+	if literals < len(p.input) {
+		length := len(p.input) - literals
+		optimal = &Block{optimal.Bits + 1 + eliasGammaBits(length) + length*8, len(p.input) - 1, 0, optimal}
+	}
+	return optimal
+}
@@ -0,0 +1,59 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import "testing"
+
+func TestLevelsNeverCompressWorse(t *testing.T) {
+	for _, file := range testCorpus(t) {
+		previous := 0
+		for level := LEVEL_FASTEST; level <= LEVEL_OPTIMAL; level++ {
+			size := len(compress(file.input, level, 1))
+			if level > LEVEL_FASTEST && size > previous {
+				t.Errorf("%s: level %d compressed to %d bytes, level %d to %d", file.name, level, size, level-1, previous)
+			}
+			previous = size
+		}
+	}
+}
+
+func TestQuickLevelIsOptimalWithinZx7Offsets(t *testing.T) {
+	for _, file := range testCorpus(t) {
+		optimizer := NewOptimizer()
+		optimizer.SetLevel(LEVEL_QUICK)
+		quick := optimizer.Optimize(file.input, 0, MAX_OFFSET, 1, false)
+		for block := quick; block != nil; block = block.Chain {
+			if block.Offset > MAX_OFFSET_ZX7 {
+				t.Fatalf("%s: offset %d used", file.name, block.Offset)
+			}
+		}
+		optimizer.SetLevel(LEVEL_OPTIMAL)
+		if optimal := optimizer.Optimize(file.input, 0, MAX_OFFSET_ZX7, 1, false); quick.Bits != optimal.Bits {
+			t.Errorf("%s: quick compression took %d bits, optimal within the same offsets %d", file.name, quick.Bits, optimal.Bits)
+		}
+	}
+}
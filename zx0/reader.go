@@ -0,0 +1,133 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+const CONTAINER_CACHE_BLOCKS = 4
+
+// ContainerReader gives random access to the decompressed data of a block
+// container, decompressing only the blocks needed and caching the most
+// recently used ones. When blocks use a dictionary, all blocks preceding
+// the ones read are decompressed too, so reading in order is much faster.
+// It's safe for concurrent use.
+type ContainerReader struct {
+	*Container
+	mutex sync.Mutex
+	cache []cachedBlock
+
+	// blocks using a dictionary are decompressed in order, keeping the end
+	// of the data decompressed so far
+	next    int
+	history []byte
+}
+
+type cachedBlock struct {
+	block int
+	data  []byte
+}
+
+// NewContainerReader reads the header of a container of the given size.
+func NewContainerReader(reader io.ReaderAt, size int64) (*ContainerReader, error) {
+	container, err := ReadContainer(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerReader{Container: container}, nil
+}
+
+// Size returns the size of the decompressed data.
+func (r *ContainerReader) Size() int64 {
+	return int64(r.Container.Size)
+}
+
+// ReadAt reads decompressed data starting at the given position, as
+// defined by io.ReaderAt.
+func (r *ContainerReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < r.Size() {
+		position := int(off) + n
+		block := r.Find(position)
+		data, err := r.block(block)
+		if err != nil {
+			return n, err
+		}
+		start, _ := r.BlockRange(block)
+		n += copy(p[n:], data[position-start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the decompressed data of a block.
+func (r *ContainerReader) block(block int) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, cached := range r.cache {
+		if cached.block == block {
+			// move to the front, as the most recently used
+			copy(r.cache[1:i+1], r.cache[:i])
+			r.cache[0] = cached
+			return cached.data, nil
+		}
+	}
+
+	var data []byte
+	var err error
+	if r.Dictionary == 0 {
+		data, err = r.DecompressBlock(block, nil)
+	} else {
+		if block < r.next {
+			r.next, r.history = 0, nil
+		}
+		for ; r.next <= block && err == nil; r.next++ {
+			data, err = r.DecompressBlock(r.next, r.history)
+			r.history = append(r.history, data...)
+			r.history = r.history[max(len(r.history)-r.Dictionary, 0):]
+		}
+	}
+	if err != nil {
+		r.next, r.history = 0, nil
+		return nil, err
+	}
+
+	if len(r.cache) < CONTAINER_CACHE_BLOCKS {
+		r.cache = append(r.cache, cachedBlock{})
+	}
+	copy(r.cache[1:], r.cache)
+	r.cache[0] = cachedBlock{block, data}
+	return data, nil
+}
@@ -0,0 +1,126 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// testContainerReader compresses the corpus into a container, and returns a
+// reader for it along with the input.
+func testContainerReader(t *testing.T, dictionary int) (*ContainerReader, []byte) {
+	input := testContainerInput(t)
+	data := CompressContainer(input, TEST_BLOCK_SIZE, dictionary, LEVEL_FASTEST, 2, false)
+	reader, err := NewContainerReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Size() != int64(len(input)) {
+		t.Fatalf("reader of %d bytes for %d", reader.Size(), len(input))
+	}
+	return reader, input
+}
+
+func TestContainerReaderReadAt(t *testing.T) {
+	for _, dictionary := range []int{0, 256} {
+		reader, input := testContainerReader(t, dictionary)
+		random := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			offset := random.Intn(len(input))
+			buffer := make([]byte, random.Intn(3*TEST_BLOCK_SIZE))
+			n, err := reader.ReadAt(buffer, int64(offset))
+			expected := min(len(buffer), len(input)-offset)
+			if n != expected || !bytes.Equal(buffer[:n], input[offset:offset+n]) {
+				t.Fatalf("dictionary %d: read %d bytes at %d, expected %d", dictionary, n, offset, expected)
+			}
+			if (n < len(buffer)) != (err == io.EOF) || (err != nil && err != io.EOF) {
+				t.Fatalf("dictionary %d: read %d of %d bytes at %d with error %v", dictionary, n, len(buffer), offset, err)
+			}
+		}
+	}
+}
+
+func TestContainerReaderConcurrentReads(t *testing.T) {
+	for _, dictionary := range []int{0, 256} {
+		reader, input := testContainerReader(t, dictionary)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				random := rand.New(rand.NewSource(seed))
+				for j := 0; j < 50; j++ {
+					offset := random.Intn(len(input))
+					buffer := make([]byte, min(random.Intn(TEST_BLOCK_SIZE), len(input)-offset))
+					if n, err := reader.ReadAt(buffer, int64(offset)); err != nil || !bytes.Equal(buffer[:n], input[offset:offset+n]) {
+						t.Errorf("dictionary %d: wrong data read at %d (%v)", dictionary, offset, err)
+						return
+					}
+				}
+			}(int64(i))
+		}
+		wg.Wait()
+	}
+}
+
+func TestContainerReaderNegativeOffset(t *testing.T) {
+	reader, _ := testContainerReader(t, 0)
+	if n, err := reader.ReadAt(make([]byte, 16), -1); n != 0 || err == nil || err == io.ErrUnexpectedEOF || err == io.EOF {
+		t.Errorf("read %d bytes at a negative offset, with error %v", n, err)
+	}
+}
+
+func TestContainerReaderCache(t *testing.T) {
+	for _, dictionary := range []int{0, 256} {
+		reader, input := testContainerReader(t, dictionary)
+		blocks := len(reader.Blocks)
+		if blocks <= CONTAINER_CACHE_BLOCKS {
+			t.Fatalf("only %d blocks to cache", blocks)
+		}
+		buffer := make([]byte, 1)
+		for _, block := range []int{0, 1, 2, 3, 4, 5, 0, blocks - 1, 2, 0} {
+			start, _ := reader.BlockRange(block)
+			if _, err := reader.ReadAt(buffer, int64(start)); err != nil || buffer[0] != input[start] {
+				t.Fatalf("dictionary %d: wrong data read from block %d (%v)", dictionary, block, err)
+			}
+			if len(reader.cache) > CONTAINER_CACHE_BLOCKS || reader.cache[0].block != block {
+				t.Fatalf("dictionary %d: block %d not cached first, %d blocks cached", dictionary, block, len(reader.cache))
+			}
+		}
+		cached := map[int]bool{}
+		for _, entry := range reader.cache {
+			cached[entry.block] = true
+		}
+		if len(cached) != CONTAINER_CACHE_BLOCKS || !cached[0] || !cached[2] || !cached[blocks-1] || !cached[5] {
+			t.Errorf("dictionary %d: blocks %v cached, expected the last ones read", dictionary, cached)
+		}
+	}
+}
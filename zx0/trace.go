@@ -0,0 +1,100 @@
+/*
+ * (c) Copyright 2021 by Einar Saukas. All rights reserved.
+ * (c) Copyright 2024 by Artur 'Mojzesh' Torun. All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * The name of its author may not be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL <COPYRIGHT HOLDER> BE LIABLE FOR ANY
+ * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package zx0
+
+import "fmt"
+
+type TokenType int
+
+const (
+	TOKEN_LITERALS TokenType = iota
+	TOKEN_LAST_OFFSET
+	TOKEN_NEW_OFFSET
+	TOKEN_END
+)
+
+func (t TokenType) String() string {
+	switch t {
+	case TOKEN_LITERALS:
+		return "literals"
+	case TOKEN_LAST_OFFSET:
+		return "last-offset"
+	case TOKEN_NEW_OFFSET:
+		return "new-offset"
+	case TOKEN_END:
+		return "end"
+	}
+	return "unknown"
+}
+
+// Token is a single command of a compressed stream, as read by the
+// decompressor or written by the compressor.
+type Token struct {
+	Type TokenType
+	// position of the first bit of the token, including the indicator bit
+	// choosing its type, counted from the most significant bit of the first
+	// byte of the stream
+	BitPosition int
+	// raw interlaced Elias gamma bits of the offset MSB, for new offsets and
+	// the end marker
+	OffsetBits string
+	// offset LSB byte, for new offsets
+	OffsetLSB int
+	// raw interlaced Elias gamma bits of the length
+	LengthBits string
+	Offset     int
+	Length     int
+	// position in the decompressed data of the first byte written
+	OutputPosition int
+}
+
+// Tracer receives every token of a stream in order.
+type Tracer func(token Token)
+
+// Reversed converts the positions of a token traced with data reversed for
+// backwards mode, so they refer to the files as stored.
+func (t Token) Reversed(compressedSize, decompressedSize int) Token {
+	t.BitPosition = (compressedSize-1-t.BitPosition/8)*8 + t.BitPosition%8
+	t.OutputPosition = decompressedSize - 1 - t.OutputPosition
+	return t
+}
+
+func (t Token) String() string {
+	line := fmt.Sprintf("%6d.%d  %-11s", t.BitPosition/8, t.BitPosition%8, t.Type)
+	switch t.Type {
+	case TOKEN_LITERALS:
+		line += fmt.Sprintf("  out %-6d  length %-6d  bits %s", t.OutputPosition, t.Length, t.LengthBits)
+	case TOKEN_LAST_OFFSET:
+		line += fmt.Sprintf("  out %-6d  length %-6d  offset %-6d  bits %s", t.OutputPosition, t.Length, t.Offset, t.LengthBits)
+	case TOKEN_NEW_OFFSET:
+		line += fmt.Sprintf("  out %-6d  length %-6d  offset %-6d  bits %s %02x %s",
+			t.OutputPosition, t.Length, t.Offset, t.OffsetBits, t.OffsetLSB, t.LengthBits)
+	case TOKEN_END:
+		line += fmt.Sprintf("  out %-6d  bits %s", t.OutputPosition, t.OffsetBits)
+	}
+	return line
+}